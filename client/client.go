@@ -2,12 +2,16 @@ package client
 
 import (
 	"bytes"
-	"encoding/base64"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"database/sql"
 	"encoding/gob"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/awgh/bencrypt/bc"
@@ -16,52 +20,128 @@ import (
 	"github.com/awgh/ratnet/api"
 )
 
-var (
-	// HUSHCOM - Destination name for the Hushcom Server
-	HUSHCOM = "HushComServer"
-	// HUSHCOMPKA - ASCII base64 version of Server PubKey
-	HUSHCOMPKA = "EuUE0KI4cySH/BkLSHlr7iBAaYikdYAC6M0GhxMk3Ew="
-	// HUSHCOMPK - binary version of Server PubKey
-	HUSHCOMPK bc.PubKey
-)
-
 // JSONResp - Response Structure to AJAX
 type JSONResp struct {
 	From    string
 	MsgType string
 	Channel string
 	Data    interface{}
+
+	// Network - the Hushcom server the event came from or is about, empty if it isn't tied to one
+	Network string `json:",omitempty"`
+	// Verified - the message signature matched the sender's known key
+	Verified bool `json:",omitempty"`
+	// KeyFingerprint - fingerprint of the key the message was checked against, empty if the sender's key is unknown
+	KeyFingerprint string `json:",omitempty"`
 }
 
+// maxPendingPerUser - messages held for one user while their keys are looked up
+const maxPendingPerUser = 64
+
+// maxPending - messages held for all users while their keys are looked up
+const maxPending = 1024
+
+// whoisTimeout - how long a Whois goes unanswered before the user is taken as not found
+const whoisTimeout = time.Minute
+
+// joinInterval - least time between two JoinChan from a user for a channel that are answered
+const joinInterval = 10 * time.Second
+
+// maxJoinTimes - users and channels whose last JoinChan is kept, see allowJoin
+const maxJoinTimes = 1024
+
+// maxChanKeyChecks - NamesResp without a rotated channel key before it's dropped, see applyChanKey
+const maxChanKeyChecks = 3
+
+// chanKeyRecheck - wait before asking the server again for a rotated key it doesn't have yet
+const chanKeyRecheck = 5 * time.Second
+
 // Client - Hushcom Client
 type Client struct {
 	// Globals
-	userKeys map[string]bc.PubKey // map of username to binary public key (not b64)
+	userKeys map[string]bc.PubKey         // binary public keys (not b64), by netKey of network and username
+	sigKeys  map[string]ed25519.PublicKey // signing public keys, by netKey of network and username
 	Node     api.Node
+	DB       func() *sql.DB
 
 	CurrentProfileName   string
 	CurrentProfilePubKey bc.PubKey
+	CurrentProfileSigKey ed25519.PrivateKey
+	historyKey           []byte // encrypts the current profile's message history
+
+	// Replay - optional, drops stale and replayed messages
+	Replay *hushcom.ReplayCache
+
+	// Peer messages waiting on a Whois lookup of the other user's keys
+	pendingOut map[string][]func(bc.PubKey) error // outgoing sends, by netKey of network and recipient
+	pendingIn  map[string][]pendingMsg            // incoming, by sender
+	pendingLen int                                // messages in pendingOut and pendingIn, see maxPending
+	whoisIDs   map[string]whoisLookup             // Whois lookups still unanswered, by RequestID
+	whoisOut   map[string]string                  // RequestID of the unanswered Whois, by netKey of network and user
+	whoisSent  map[string]int                     // Whois lookups still unanswered, by user
+	keysMutex  sync.Mutex                         // guards userKeys, sigKeys, the pending maps and the Whois maps
+
+	// Last known channel members, from NamesResp
+	chanMembers     map[string]hushcom.NamesRespMsg
+	pendingChanKeys map[string]chanKeyUpdate // rotated keys waiting on the server, by channel
+	membersMutex    sync.Mutex
+
+	// Join requests for private channels, waiting on approval
+	pendingJoins map[string]JoinRequest
+	joinsOut     map[string]JoinRequest // our own join requests waiting on a JoinChanResp, by channel
+	joinTimes    map[string]time.Time   // last JoinChan answered, by joinKey, see allowJoin
+	joinChecks   map[string]joinCheck   // JoinChan waiting on a NamesResp, by joinKey, see checkJoin
+	joinsMutex   sync.Mutex
+
+	// Subscribers to the event stream, see SubscribeEvents
+	events eventHub
 
-	// Output - Buffered AJAX Output
-	Output string
+	// Channel keys rotated out lately, see Router
+	retired retiredKeys
+
+	// Hushcom servers, see SetServer
+	servers serverState
+
+	// Blocking requests waiting on a server reply, by RequestID
+	requests      map[string]pendingRequest
+	requestsMutex sync.Mutex
 }
 
 // New : Make a new instance of Hushcom Client
-func New(node api.Node) *Client {
+func New(node api.Node, db func() *sql.DB) *Client {
 
 	client := new(Client)
 	client.CurrentProfileName = ""
 	client.CurrentProfilePubKey = nil
 	client.Node = node
+	client.DB = db
 
 	client.userKeys = make(map[string]bc.PubKey)
+	client.sigKeys = make(map[string]ed25519.PublicKey)
+	client.Replay = hushcom.NewReplayCache(hushcom.DefaultMaxSkew, hushcom.DefaultReplayCacheSize)
+	client.pendingOut = make(map[string][]func(bc.PubKey) error)
+	client.pendingIn = make(map[string][]pendingMsg)
+	client.whoisIDs = make(map[string]whoisLookup)
+	client.whoisOut = make(map[string]string)
+	client.whoisSent = make(map[string]int)
+	client.servers.nets = make(map[string]*network)
+	client.requests = make(map[string]pendingRequest)
+	client.pendingJoins = make(map[string]JoinRequest)
+	client.joinsOut = make(map[string]JoinRequest)
+	client.joinTimes = make(map[string]time.Time)
+	client.joinChecks = make(map[string]joinCheck)
+	client.chanMembers = make(map[string]hushcom.NamesRespMsg)
+	client.pendingChanKeys = make(map[string]chanKeyUpdate)
+	client.events.init(DefaultEventHistory)
+	client.retired.reset(nil)
 
-	hcpk := new(ecc.PubKey)
-	hcpk.FromB64(HUSHCOMPKA)
-	HUSHCOMPK = hcpk
-	client.userKeys[HUSHCOM] = hcpk
+	if err := client.bootstrapDB(); err != nil {
+		log.Println("HushCom Client DB setup failed: " + err.Error())
+	}
+	if err := client.loadServers(); err != nil {
+		log.Println("HushCom Client server setup failed: " + err.Error())
+	}
 
-	client.Output = ""
 	return client
 }
 
@@ -70,6 +150,45 @@ func (*Client) GetName() string {
 	return "HushCom Client Module"
 }
 
+// LoadProfile - Load a profile as the content key and derive its signing key
+func (modInst *Client) LoadProfile(name string) error {
+	key, err := modInst.Node.LoadProfile(name)
+	if err != nil {
+		return err
+	}
+	c := modInst.DB()
+	defer c.Close()
+	var privKey string
+	row := c.QueryRow("SELECT privkey FROM profiles WHERE name==$1;", name)
+	if err := row.Scan(&privKey); err != nil {
+		return err
+	}
+	sigKey, err := hushcom.SigningKey(privKey)
+	if err != nil {
+		return err
+	}
+	histKey, err := historyKey(privKey)
+	if err != nil {
+		return err
+	}
+	modInst.CurrentProfileName = name
+	modInst.CurrentProfilePubKey = key
+	modInst.CurrentProfileSigKey = sigKey
+	modInst.historyKey = histKey
+
+	// keys learned under another profile aren't pinned for this one
+	modInst.keysMutex.Lock()
+	for user := range modInst.userKeys {
+		delete(modInst.userKeys, user)
+		delete(modInst.sigKeys, user)
+	}
+	modInst.keysMutex.Unlock()
+	if err := modInst.loadRetiredKeys(); err != nil {
+		return err
+	}
+	return modInst.loadContactKeys()
+}
+
 // HandleMsg - handler for messages
 func (modInst *Client) HandleMsg(msg api.Msg) error {
 
@@ -95,38 +214,29 @@ func (modInst *Client) HandleMsg(msg api.Msg) error {
 	switch metaData.MsgType {
 	// From Peers
 	// - JoinChan: Channel join request
-	// - JoinChanResp: Channel join response
+	// - JoinChanResp: Channel join response (verified against the sender's looked-up key)
+	// - PrivMsg: Private message (verified against the sender's looked-up key)
+	// - ChanKey: New channel key after rotation (verified against the sender's looked-up key)
+	// - Channel: Channel message
 	case "JoinChan":
 		var msgObj hushcom.JoinChanMsg
 		if err := json.Unmarshal(metaData.Data, &msgObj); err != nil {
 			return errors.New("Could not unmarshal 'JoinChan' message")
 		}
-		//todo: check password here, currently only auto-accepts
-		k := new(ecc.PubKey)
-		if err := k.FromB64(msgObj.ReqPubKey); err != nil {
-			return err
+		// one admin answers, so the password isn't checked by everyone in the channel
+		if msgObj.Responder != modInst.CurrentProfileName {
+			return nil
 		}
-		modInst.userKeys[metaData.From] = k
-		result, err := modInst.Node.GetChannelPrivKey(msgObj.Channel)
+		sk, err := hushcom.SigKeyFromB64(msgObj.ReqSigKey)
 		if err != nil {
 			return err
 		}
-		var resp hushcom.JoinChanRespMsg
-		resp.Channel = string(msgObj.Channel)
-		resp.ChannelKey = string(result)
-		l("Sending JoinChanResp with:")
-		l("   From:\t", metaData.From)
-		//l("   Signing Key:", modInst.CurrentProfilePubKey)
-		l("   DestKey:\t", msgObj.ReqPubKey)
-
-		bx, ex := base64.StdEncoding.DecodeString(string(result))
-		l("   ChanKey:\t", bx, ex)
-
-		if err := modInst.HCSend("JoinChanResp", false, metaData.From,
-			modInst.CurrentProfilePubKey, k, resp); err != nil {
-			return err
+		// the request must at least be signed by the key it carries before we look the sender up
+		if !hushcom.VerifyMsg(sk, metaData) {
+			return errors.New("Failure to authenticate JoinChan from: " + metaData.From + " with signature " + hex.EncodeToString(metaData.Sig) + ".")
 		}
-		return nil // end of JoinChan case
+		// the keys it carries are only taken if the channel's server has them for the sender, see handleJoinChan
+		return modInst.recvFromUser(metaData)
 
 	case "JoinChanResp":
 		l("JOIN CHANNEL RESPONSE RECEIVED")
@@ -134,90 +244,618 @@ func (modInst *Client) HandleMsg(msg api.Msg) error {
 		if err := json.Unmarshal(metaData.Data, &msgObj); err != nil {
 			return errors.New("Could not unmarshal 'JoinChanResp' message")
 		}
-		if err := modInst.Node.AddChannel(msgObj.Channel, msgObj.ChannelKey); err != nil {
-			return err
-		}
-		crypt := new(ecc.KeyPair)
-		crypt.FromB64(msgObj.ChannelKey)
-		pk := crypt.GetPubKey()
-
-		var resp hushcom.ChannelMsg
-		resp.Channel = msgObj.Channel
-		resp.Text = metaData.From + " has admitted " + modInst.CurrentProfileName + " to channel."
-
-		if err := modInst.HCSend("Channel", true, msgObj.Channel,
-			modInst.CurrentProfilePubKey, pk, resp); err != nil {
-			return err
+		if modInst.joinNetwork(msgObj.Channel) == "" {
+			return errors.New("JoinChanResp from " + metaData.From + " for " + msgObj.Channel + ", which we didn't ask to join")
 		}
-		return nil
+		return modInst.recvFromUser(metaData)
 
-	case "Channel":
-		var msgObj hushcom.ChannelMsg
-		if err := json.Unmarshal(metaData.Data, &msgObj); err != nil {
-			return errors.New("Could not unmarshal 'Channel' message")
-		}
-		// todo: check signature and pass an "authenticated" flag to UI
-		var resp JSONResp
-		resp.MsgType = metaData.MsgType
-		resp.From = metaData.From
-		resp.Channel = msgObj.Channel
-		resp.Data = msgObj.Text
-		outb, err := json.Marshal(resp)
-		if err != nil {
-			log.Println("JSON Marshal failed in Channel")
-			return err
-		}
-		modInst.Output += string(outb) + "\n"
-		//log.Println("Handled Unauthenticated Message: ", metaData.MsgType)
-		return nil
+	case "PrivMsg", "ChanKey", "Channel":
+		return modInst.recvFromUser(metaData)
 	}
 
-	// Verify that the msg signature matches the user's key
-	if !hushcom.VerifyMsg(HUSHCOMPK, metaData) {
+	// Verify that the msg signature matches a connected server's signing key
+	net := modInst.serverFor(metaData)
+	if net == nil {
 		return errors.New("Failure to authenticate user: " + metaData.From + " with signature " + hex.EncodeToString(metaData.Sig) + ".")
 	}
 	// At this point, the message is considered authenticated.
 	l("Message Passed Auth: ", metaData.MsgType)
 
+	// Drop stale and replayed messages
+	if err := modInst.checkReplay(metaData); err != nil {
+		return err
+	}
+
+	// after it's been handled, wake up whoever is waiting on this reply
+	defer modInst.deliver(net.Name, metaData)
+
 	// Authenticated (signature-checked) Message Handlers
 	switch metaData.MsgType {
 	// Client-Handled Messages:
 	// From Server
 	// - RegisterResp: Register a new nick/pubkey pair
 	// - ListChans: Enumerate public channels
+	// - WhoisResp: A user's keys
+	// - NamesResp: A channel's admins and members
+	// - ChanAdminResp: Result of a Kick, Ban, Unban, Op, Deop or TransferOwner
+	// - NewChanResp: Our channel was created
+	// - RotateChanKeyResp: Our new channel key was registered
+	// - ErrorResp: One of our messages was rejected
 	case "RegisterResp":
 		var msgObj hushcom.RegisterRespMsg
 		if err := json.Unmarshal(metaData.Data, &msgObj); err != nil {
 			return errors.New("Could not unmarshal 'RegisterResp' message")
 		}
+		modInst.updateServer(net, func(n *Network) { n.Registered = msgObj.Success })
+		return modInst.emit(RegisterResult{Network: net.Name, From: metaData.From, Success: msgObj.Success})
+
+	case "ListChansResp":
+		var msgObj hushcom.ListChansRespMsg
+		if err := json.Unmarshal(metaData.Data, &msgObj); err != nil {
+			return errors.New("Could not unmarshal 'ListChansResp' message")
+		}
+		modInst.updateServer(net, func(n *Network) { n.Channels = msgObj.Channels })
+		return modInst.emit(ChannelList{Network: net.Name, From: metaData.From, Channels: msgObj.Channels})
+
+	case "WhoisResp":
+		var msgObj hushcom.WhoisRespMsg
+		if err := json.Unmarshal(metaData.Data, &msgObj); err != nil {
+			return errors.New("Could not unmarshal 'WhoisResp' message")
+		}
 		var resp JSONResp
 		resp.MsgType = metaData.MsgType
 		resp.From = metaData.From
+		resp.Network = net.Name
 		resp.Data = msgObj
-		outb, err := json.Marshal(resp)
-		if err != nil {
-			log.Println("JSON Marshal failed in RegisterResp")
+		if err := modInst.emit(resp); err != nil {
 			return err
 		}
-		modInst.Output += string(outb) + "\n"
+		modInst.whoisAnswered(net.Name, metaData.RequestID)
+		return modInst.handleWhoisResp(net.Name, msgObj)
 
-	case "ListChansResp":
-		var msgObj hushcom.ListChansRespMsg
+	case "NamesResp":
+		var msgObj hushcom.NamesRespMsg
 		if err := json.Unmarshal(metaData.Data, &msgObj); err != nil {
-			return errors.New("Could not unmarshal 'ListChansResp' message")
+			return errors.New("Could not unmarshal 'NamesResp' message")
+		}
+		modInst.membersMutex.Lock()
+		modInst.chanMembers[msgObj.Channel] = msgObj
+		modInst.membersMutex.Unlock()
+		var resp JSONResp
+		resp.MsgType = metaData.MsgType
+		resp.From = metaData.From
+		resp.Channel = msgObj.Channel
+		resp.Network = net.Name
+		resp.Data = msgObj
+		if err := modInst.emit(resp); err != nil {
+			return err
+		}
+		if err := modInst.answerJoins(msgObj); err != nil {
+			return err
+		}
+		return modInst.applyChanKey(net.Name, msgObj)
+
+	case "ChanAdminResp":
+		var msgObj hushcom.ChanAdminRespMsg
+		if err := json.Unmarshal(metaData.Data, &msgObj); err != nil {
+			return errors.New("Could not unmarshal 'ChanAdminResp' message")
+		}
+		modInst.membersMutex.Lock()
+		modInst.chanMembers[msgObj.Channel] = hushcom.NamesRespMsg{Channel: msgObj.Channel,
+			Owner: msgObj.Owner, Admins: msgObj.Admins, Users: msgObj.Users, Bans: msgObj.Bans}
+		modInst.membersMutex.Unlock()
+		var resp JSONResp
+		resp.MsgType = metaData.MsgType
+		resp.From = metaData.From
+		resp.Channel = msgObj.Channel
+		resp.Network = net.Name
+		resp.Data = msgObj
+		if err := modInst.emit(resp); err != nil {
+			return err
+		}
+		return modInst.handleChanAdminResp(msgObj)
+
+	case "NewChanResp":
+		var msgObj hushcom.NewChanRespMsg
+		if err := json.Unmarshal(metaData.Data, &msgObj); err != nil {
+			return errors.New("Could not unmarshal 'NewChanResp' message")
+		}
+		var resp JSONResp
+		resp.MsgType = metaData.MsgType
+		resp.From = metaData.From
+		resp.Channel = msgObj.ChanName
+		resp.Network = net.Name
+		resp.Data = msgObj
+		return modInst.emit(resp)
+
+	case "RotateChanKeyResp":
+		var msgObj hushcom.RotateChanKeyRespMsg
+		if err := json.Unmarshal(metaData.Data, &msgObj); err != nil {
+			return errors.New("Could not unmarshal 'RotateChanKeyResp' message")
+		}
+		var resp JSONResp
+		resp.MsgType = metaData.MsgType
+		resp.From = metaData.From
+		resp.Channel = msgObj.ChanName
+		resp.Network = net.Name
+		resp.Data = msgObj
+		return modInst.emit(resp)
+
+	case "ErrorResp":
+		var msgObj hushcom.ErrorRespMsg
+		if err := json.Unmarshal(metaData.Data, &msgObj); err != nil {
+			return errors.New("Could not unmarshal 'ErrorResp' message")
+		}
+		l("Server rejected "+msgObj.MsgType+": ", msgObj.Code, msgObj.Error)
+		if err := modInst.emit(ServerError{Network: net.Name, From: metaData.From, Code: msgObj.Code,
+			MsgType: msgObj.MsgType, CorrelationID: msgObj.CorrelationID, Error: msgObj.Error}); err != nil {
+			return err
+		}
+		if msgObj.MsgType == "Whois" {
+			// a throttled Whois won't be answered, give up on what was waiting for it
+			if lookup, ok := modInst.whoisAnswered(net.Name, msgObj.CorrelationID); ok {
+				return modInst.handleWhoisResp(net.Name, hushcom.WhoisRespMsg{Name: lookup.name})
+			}
+		}
+		return nil
+	}
+
+	return nil
+}
+
+// checkReplay - Drop stale and replayed messages. Only call this once the signature has been
+// checked, the cache is keyed by sender and forgeries would push out their real entries.
+func (modInst *Client) checkReplay(metaData hushcom.Msg) error {
+	if modInst.Replay == nil {
+		return nil
+	}
+	return modInst.Replay.Check(metaData)
+}
+
+// sendToUser - Send a message to a user's key, looking it up on the network's server first if needed
+func (modInst *Client) sendToUser(network string, to string, msgType string, hcmsg interface{}) error {
+	net, err := modInst.server(network)
+	if err != nil {
+		return err
+	}
+	send := func(destKey bc.PubKey) error {
+		return modInst.HCSend(msgType, false, to, modInst.CurrentProfileSigKey, destKey, hcmsg)
+	}
+	key := netKey(net.Name, to)
+	modInst.keysMutex.Lock()
+	destKey, ok := modInst.userKeys[key]
+	full := !ok && modInst.pendingFull(len(modInst.pendingOut[key]))
+	if !ok && !full {
+		modInst.pendingOut[key] = append(modInst.pendingOut[key], send)
+		modInst.pendingLen++
+	}
+	modInst.keysMutex.Unlock()
+	if full {
+		return errors.New("Too many messages waiting on the keys of " + to + ", dropped")
+	}
+	if !ok {
+		return modInst.NewWhoisMsg(net.Name, to)
+	}
+	return send(destKey)
+}
+
+// pendingFull - no room for another message waiting on a Whois, next to queued others for the same user.
+// Call with keysMutex held.
+func (modInst *Client) pendingFull(queued int) bool {
+	return queued >= maxPendingPerUser || modInst.pendingLen >= maxPending
+}
+
+// pendingMsg - a message from a user whose signing key we're looking up
+type pendingMsg struct {
+	network string // where the sender is a user, empty if it could be any connected network
+	msg     hushcom.Msg
+}
+
+// recvFromUser - Handle a message from a user, looking up their signing key first if needed:
+// on the channel's server for channel and join messages, on every connected server otherwise
+func (modInst *Client) recvFromUser(metaData hushcom.Msg) error {
+	var about struct{ Channel string }
+	json.Unmarshal(metaData.Data, &about)
+	network := ""
+	switch metaData.MsgType {
+	case "PrivMsg":
+		network = modInst.lookupSender(metaData)
+	case "JoinChanResp":
+		network = modInst.joinNetwork(about.Channel)
+	default:
+		network = modInst.channelNetwork(about.Channel)
+	}
+	modInst.keysMutex.Lock()
+	_, ok := modInst.sigKeys[netKey(network, metaData.From)]
+	if network == "" {
+		ok = false
+	}
+	if metaData.From == modInst.CurrentProfileName {
+		ok = true // our own channel messages come back to us
+	}
+	full := !ok && modInst.pendingFull(len(modInst.pendingIn[metaData.From]))
+	if !ok && !full {
+		// hold the message until the server tells us who the sender is
+		modInst.pendingIn[metaData.From] = append(modInst.pendingIn[metaData.From], pendingMsg{network, metaData})
+		modInst.pendingLen++
+	}
+	modInst.keysMutex.Unlock()
+	if full {
+		return errors.New("Too many messages waiting on the keys of " + metaData.From + ", dropped")
+	}
+	if ok {
+		return modInst.handleFromUser(network, metaData)
+	}
+	if network != "" {
+		return modInst.NewWhoisMsg(network, metaData.From)
+	}
+	for _, net := range modInst.GetNetworks() {
+		if err := modInst.NewWhoisMsg(net.Name, metaData.From); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookupSender - the network whose user of that name signed a message, empty if we know of none.
+// Private messages don't say which network they're from.
+func (modInst *Client) lookupSender(metaData hushcom.Msg) string {
+	nets := modInst.GetNetworks()
+	modInst.keysMutex.Lock()
+	defer modInst.keysMutex.Unlock()
+	for _, net := range nets {
+		if sigKey, ok := modInst.sigKeys[netKey(net.Name, metaData.From)]; ok && hushcom.VerifyMsg(sigKey, metaData) {
+			return net.Name
 		}
+	}
+	return ""
+}
+
+// handleFromUser - Verify a message against the sender's known signing key on a network and dispatch it
+func (modInst *Client) handleFromUser(network string, metaData hushcom.Msg) error {
+	modInst.keysMutex.Lock()
+	sigKey := modInst.sigKeys[netKey(network, metaData.From)]
+	modInst.keysMutex.Unlock()
+	if metaData.From == modInst.CurrentProfileName && modInst.CurrentProfileSigKey != nil {
+		sigKey = modInst.CurrentProfileSigKey.Public().(ed25519.PublicKey)
+	}
+	if metaData.MsgType == "Channel" {
+		// channel messages are shown either way, flagged with the result
+		return modInst.handleChannelMsg(network, metaData, sigKey)
+	}
+	if !hushcom.VerifyMsg(sigKey, metaData) {
+		return errors.New("Failure to authenticate " + metaData.MsgType + " from: " + metaData.From + " with signature " + hex.EncodeToString(metaData.Sig) + ".")
+	}
+	if err := modInst.checkReplay(metaData); err != nil {
+		return err
+	}
+	switch metaData.MsgType {
+	case "PrivMsg":
+		return modInst.handlePrivMsg(network, metaData)
+	case "ChanKey":
+		return modInst.handleChanKey(network, metaData)
+	case "JoinChanResp":
+		return modInst.handleJoinChanResp(network, metaData)
+	case "JoinChan":
+		return modInst.handleJoinChan(network, metaData)
+	}
+	return errors.New("Unknown message type from user " + metaData.From + ".")
+}
+
+// handleJoinChan - a join request from a user whose keys the server confirmed, see checkJoin
+func (modInst *Client) handleJoinChan(network string, metaData hushcom.Msg) error {
+	var msgObj hushcom.JoinChanMsg
+	if err := json.Unmarshal(metaData.Data, &msgObj); err != nil {
+		return errors.New("Could not unmarshal 'JoinChan' message")
+	}
+	modInst.keysMutex.Lock()
+	k := modInst.userKeys[netKey(network, metaData.From)]
+	sk := modInst.sigKeys[netKey(network, metaData.From)]
+	modInst.keysMutex.Unlock()
+	if k == nil || k.ToB64() != msgObj.ReqPubKey || hushcom.SigKeyToB64(sk) != msgObj.ReqSigKey {
+		return errors.New("JoinChan from " + metaData.From + " with keys that don't match the pinned ones")
+	}
+	if !modInst.allowJoin(msgObj.Channel, metaData.From, time.Now()) {
+		log.Println("JoinChan from " + metaData.From + " to " + msgObj.Channel + " is over the rate limit, dropped")
+		return nil
+	}
+	// answered once the server's member list shows we're an admin and they aren't banned
+	req := JoinRequest{Network: network, Channel: msgObj.Channel, From: metaData.From,
+		Responder: msgObj.Responder, Key: k}
+	return modInst.checkJoin(req, msgObj.Password)
+}
+
+// handlePrivMsg - pass a verified private message to the UI
+func (modInst *Client) handlePrivMsg(network string, metaData hushcom.Msg) error {
+	var msgObj hushcom.PrivMsg
+	if err := json.Unmarshal(metaData.Data, &msgObj); err != nil {
+		return errors.New("Could not unmarshal 'PrivMsg' message")
+	}
+	// signed for someone else and passed on to us
+	if msgObj.To != modInst.CurrentProfileName {
+		return errors.New("PrivMsg from " + metaData.From + " is addressed to " + msgObj.To)
+	}
+	var resp JSONResp
+	resp.MsgType = metaData.MsgType
+	resp.From = metaData.From
+	resp.Data = msgObj.Text
+	resp.Verified = true
+	resp.Network = network
+	modInst.keysMutex.Lock()
+	resp.KeyFingerprint = hushcom.Fingerprint(modInst.sigKeys[netKey(network, metaData.From)])
+	modInst.keysMutex.Unlock()
+	return modInst.emit(resp)
+}
+
+// handleJoinChanResp - join a channel with the key from a verified JoinChanResp, if we asked to join it
+func (modInst *Client) handleJoinChanResp(network string, metaData hushcom.Msg) error {
+	var msgObj hushcom.JoinChanRespMsg
+	if err := json.Unmarshal(metaData.Data, &msgObj); err != nil {
+		return errors.New("Could not unmarshal 'JoinChanResp' message")
+	}
+	modInst.joinsMutex.Lock()
+	join, ok := modInst.joinsOut[msgObj.Channel]
+	ok = ok && join.Network == network && (join.Responder == "" || join.Responder == metaData.From)
+	if ok {
+		delete(modInst.joinsOut, msgObj.Channel)
+	}
+	modInst.joinsMutex.Unlock()
+	if !ok && join.Network == network && join.Responder != "" {
+		return errors.New("JoinChanResp from " + metaData.From + " for " + msgObj.Channel + ", we asked " + join.Responder)
+	}
+	if !ok {
+		return errors.New("JoinChanResp from " + metaData.From + " for " + msgObj.Channel + ", which we didn't ask to join")
+	}
+	if msgObj.Denied {
 		var resp JSONResp
 		resp.MsgType = metaData.MsgType
 		resp.From = metaData.From
+		resp.Channel = msgObj.Channel
+		resp.Network = network
 		resp.Data = msgObj
-		outb, err := json.Marshal(resp)
+		return modInst.emit(resp)
+	}
+	cfg, err := modInst.GetChannelConfig(network, msgObj.Channel)
+	if err != nil {
+		return err
+	}
+	if cfg == nil {
+		cfg = &ChannelConfig{Name: msgObj.Channel, Network: network}
+	}
+	if err := modInst.Node.AddChannel(msgObj.Channel, msgObj.ChannelKey); err != nil {
+		return err
+	}
+	cfg.Password = msgObj.ChanPassword
+	cfg.Private = msgObj.Private
+	if err := modInst.SetChannelConfig(cfg); err != nil {
+		return err
+	}
+	if err := modInst.NewChanJoinedMsg(msgObj.Channel); err != nil {
+		return err
+	}
+	crypt := new(ecc.KeyPair)
+	crypt.FromB64(msgObj.ChannelKey)
+	pk := crypt.GetPubKey()
+
+	var resp hushcom.ChannelMsg
+	resp.Channel = msgObj.Channel
+	resp.Text = metaData.From + " has admitted " + modInst.CurrentProfileName + " to channel."
+
+	return modInst.HCSend("Channel", true, msgObj.Channel,
+		modInst.CurrentProfileSigKey, pk, resp)
+}
+
+// handleChannelMsg - check a channel message against the sender's signing key (nil if unknown),
+// store it and pass it to the UI with the result
+func (modInst *Client) handleChannelMsg(network string, metaData hushcom.Msg, sigKey ed25519.PublicKey) error {
+	var msgObj hushcom.ChannelMsg
+	if err := json.Unmarshal(metaData.Data, &msgObj); err != nil {
+		return errors.New("Could not unmarshal 'Channel' message")
+	}
+	ev := ChannelMessage{Network: network, Channel: msgObj.Channel, From: metaData.From,
+		Text: msgObj.Text, Timestamp: time.Unix(0, metaData.Timestamp)}
+	if sigKey != nil {
+		ev.Verified = hushcom.VerifyMsg(sigKey, metaData)
+		ev.KeyFingerprint = hushcom.Fingerprint(sigKey)
+		if !ev.Verified {
+			log.Println("Channel message from " + metaData.From + " to " + msgObj.Channel + " has a bad signature")
+		}
+	}
+	// only signed messages can be told apart from replays, see checkReplay
+	if ev.Verified {
+		if err := modInst.checkReplay(metaData); err != nil {
+			return err
+		}
+	}
+	// our own messages were stored when sent, and spoofed ones aren't kept
+	if metaData.From != modInst.CurrentProfileName && (ev.Verified || sigKey == nil) {
+		if err := modInst.addHistory(network, msgObj.Channel, metaData.From, msgObj.Text, ev.Timestamp); err != nil {
+			log.Println("Could not store channel message: " + err.Error())
+		}
+	}
+	return modInst.emit(ev)
+}
+
+// chanKeyUpdate - a rotated channel key, waiting on the server to confirm it
+type chanKeyUpdate struct {
+	network string
+	from    string
+	oldKey  string
+	newKey  string
+	checks  int // NamesResp seen without the new key
+}
+
+// handleChanKey - hold a rotated channel key handed out by someone holding the old one,
+// and ask the server whether they're an admin and have registered it, see applyChanKey
+func (modInst *Client) handleChanKey(network string, metaData hushcom.Msg) error {
+	var msgObj hushcom.ChanKeyMsg
+	if err := json.Unmarshal(metaData.Data, &msgObj); err != nil {
+		return errors.New("Could not unmarshal 'ChanKey' message")
+	}
+	oldKey, err := modInst.Node.GetChannelPrivKey(msgObj.Channel)
+	if err != nil || oldKey == "" {
+		return errors.New("ChanKey from " + metaData.From + " for unknown channel " + msgObj.Channel)
+	}
+	proof, err := hushcom.ChanKeyProof(oldKey, msgObj.ChannelKey)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(proof, msgObj.Proof) {
+		return errors.New("ChanKey from " + metaData.From + " for " + msgObj.Channel + " has a bad proof")
+	}
+	modInst.membersMutex.Lock()
+	modInst.pendingChanKeys[msgObj.Channel] = chanKeyUpdate{network: network, from: metaData.From,
+		oldKey: oldKey, newKey: msgObj.ChannelKey}
+	modInst.membersMutex.Unlock()
+	return modInst.NewNamesMsg(msgObj.Channel)
+}
+
+// applyChanKey - switch to a channel's rotated key once the server's NamesResp shows it came
+// from an admin and is the one they registered with RotateChanKey. The server may not have
+// it yet, so it's asked again a few times before the key is dropped.
+func (modInst *Client) applyChanKey(network string, names hushcom.NamesRespMsg) error {
+	modInst.membersMutex.Lock()
+	upd, ok := modInst.pendingChanKeys[names.Channel]
+	if !ok || upd.network != network {
+		modInst.membersMutex.Unlock()
+		return nil
+	}
+	admin := false
+	for _, a := range names.Admins {
+		if a == upd.from {
+			admin = true
+		}
+	}
+	sigKey, err := hushcom.ChanSigKey(upd.newKey)
+	confirmed := err == nil && sigKey == names.ChanSigKey
+	upd.checks++
+	if admin && !confirmed && upd.checks < maxChanKeyChecks {
+		modInst.pendingChanKeys[names.Channel] = upd
+		modInst.membersMutex.Unlock()
+		time.AfterFunc(chanKeyRecheck, func() {
+			if err := modInst.NewNamesMsg(names.Channel); err != nil {
+				log.Println(err.Error())
+			}
+		})
+		return nil
+	}
+	delete(modInst.pendingChanKeys, names.Channel)
+	modInst.membersMutex.Unlock()
+	if !admin {
+		return errors.New("ChanKey from " + upd.from + " for " + names.Channel + ", who isn't an admin")
+	}
+	if !confirmed {
+		return errors.New("ChanKey from " + upd.from + " for " + names.Channel + " wasn't registered with the server")
+	}
+	// a later rotation may have got here first
+	if current, err := modInst.Node.GetChannelPrivKey(names.Channel); err != nil || current != upd.oldKey {
+		return errors.New("ChanKey from " + upd.from + " for " + names.Channel + " is for a key we no longer hold")
+	}
+	if err := modInst.switchChannelKey(network, names.Channel, upd.oldKey, upd.newKey); err != nil {
+		return err
+	}
+	var resp JSONResp
+	resp.MsgType = "ChanKey"
+	resp.From = upd.from
+	resp.Channel = names.Channel
+	resp.Network = network
+	return modInst.emit(resp)
+}
+
+// switchChannelKey - retire a channel's current key and start using a new one
+func (modInst *Client) switchChannelKey(network, channel, oldKey, newKey string) error {
+	if err := modInst.retireChannelKey(network, channel, oldKey); err != nil {
+		return err
+	}
+	return modInst.Node.AddChannel(channel, newKey)
+}
+
+// handleWhoisResp - cache a user's keys on a network and flush any messages waiting on them.
+// Messages that could be from a user of another network keep waiting until every Whois sent
+// for that name is answered.
+func (modInst *Client) handleWhoisResp(network string, msgObj hushcom.WhoisRespMsg) error {
+	var k bc.PubKey
+	var sk ed25519.PublicKey
+	if msgObj.Found {
+		newKey := new(ecc.PubKey)
+		if err := newKey.FromB64(msgObj.Key); err != nil {
+			return err
+		}
+		newSigKey, err := hushcom.SigKeyFromB64(msgObj.SigKey)
+		if err != nil {
+			return err
+		}
+		// a changed key raises KeyChanged, and we carry on with the pinned one
+		k, sk, _, err = modInst.pinKeys(network, msgObj.Name, newKey, newSigKey)
 		if err != nil {
-			log.Println("JSON Marshal failed in ListChansResp")
 			return err
 		}
-		modInst.Output += string(outb) + "\n"
 	}
 
+	modInst.keysMutex.Lock()
+	done := modInst.whoisSent[msgObj.Name] == 0
+	if msgObj.Found {
+		modInst.userKeys[netKey(network, msgObj.Name)] = k
+		modInst.sigKeys[netKey(network, msgObj.Name)] = sk
+	}
+	out := modInst.pendingOut[netKey(network, msgObj.Name)]
+	delete(modInst.pendingOut, netKey(network, msgObj.Name))
+	var ready, unknown, waiting []pendingMsg
+	for _, p := range modInst.pendingIn[msgObj.Name] {
+		switch {
+		case p.network != "" && p.network != network:
+			waiting = append(waiting, p) // someone else's answer
+		case msgObj.Found && (p.network != "" || hushcom.VerifyMsg(sk, p.msg)):
+			p.network = network
+			ready = append(ready, p)
+		case done:
+			unknown = append(unknown, p)
+		default:
+			waiting = append(waiting, p)
+		}
+	}
+	if done {
+		// nobody else is going to answer for the ones still waiting
+		unknown = append(unknown, waiting...)
+		waiting = nil
+	}
+	if len(waiting) > 0 {
+		modInst.pendingIn[msgObj.Name] = waiting
+	} else {
+		delete(modInst.pendingIn, msgObj.Name)
+	}
+	modInst.pendingLen -= len(out) + len(ready) + len(unknown)
+	modInst.keysMutex.Unlock()
+
+	for _, p := range ready {
+		if err := modInst.handleFromUser(p.network, p.msg); err != nil {
+			log.Println(err.Error())
+		}
+	}
+	dropped := 0
+	if !msgObj.Found {
+		dropped = len(out)
+	}
+	for _, p := range unknown {
+		// channel messages from unregistered senders are still shown, unverified
+		if p.msg.MsgType == "Channel" {
+			if err := modInst.handleChannelMsg(p.network, p.msg, nil); err != nil {
+				log.Println(err.Error())
+			}
+		} else {
+			dropped++
+		}
+	}
+	if msgObj.Found {
+		for _, send := range out {
+			if err := send(k); err != nil {
+				return err
+			}
+		}
+	}
+	if dropped > 0 {
+		return errors.New("Dropped messages for unknown user: " + msgObj.Name)
+	}
 	return nil
 }
 
@@ -227,73 +865,586 @@ func (modInst *Client) HandleMsg(msg api.Msg) error {
 // - ListChans: Enumerate public channels
 // - NewChan: Create a new channel
 
-// NewRegisterMsg - Create a "register a user" message for the Hushcom server
-func (modInst *Client) NewRegisterMsg() error {
+// NewRegisterMsg - Create a "register a user" message for a network's Hushcom server
+func (modInst *Client) NewRegisterMsg(network string) error {
+	reg, err := modInst.registerMsg()
+	if err != nil {
+		return err
+	}
+	return modInst.toServer(network, "Register", reg)
+}
+
+func (modInst *Client) registerMsg() (hushcom.RegisterMsg, error) {
 	var reg hushcom.RegisterMsg
+	if modInst.CurrentProfilePubKey == nil {
+		return reg, errors.New("No profile loaded")
+	}
 	reg.Key = modInst.CurrentProfilePubKey.ToB64()
-	return modInst.HCSend("Register", false, HUSHCOM, modInst.CurrentProfilePubKey, HUSHCOMPK, reg)
+	reg.SigKey = hushcom.SigKeyToB64(modInst.CurrentProfileSigKey.Public().(ed25519.PublicKey))
+	return reg, nil
+}
+
+// NewUnregisterMsg - Create an "Unregister a user" message for a network's Hushcom server
+func (modInst *Client) NewUnregisterMsg(network string) error {
+	net, err := modInst.server(network)
+	if err != nil {
+		return err
+	}
+	if err := modInst.toServer(net.Name, "Unregister", nil); err != nil {
+		return err
+	}
+	modInst.updateServer(net, func(n *Network) { n.Registered = false })
+	return nil
+}
+
+// NewListChansMsg - Create a "List Public Channels" message for a network's Hushcom server
+func (modInst *Client) NewListChansMsg(network string) error {
+	return modInst.toServer(network, "ListChans", nil)
 }
 
-// NewUnregisterMsg - Create an "Unregister a user" message for the Hushcom server
-func (modInst *Client) NewUnregisterMsg() error {
-	return modInst.HCSend("Unregister", false, HUSHCOM, modInst.CurrentProfilePubKey, HUSHCOMPK, nil)
+// whoisLookup - a Whois sent and not yet answered
+type whoisLookup struct {
+	network string
+	name    string
+}
+
+// NewWhoisMsg - Create a "look up a user's keys" message for a network's Hushcom server.
+// Does nothing if a lookup of the same user there is still unanswered.
+// One that isn't answered within whoisTimeout is taken as the user not being found.
+func (modInst *Client) NewWhoisMsg(network string, name string) error {
+	net, err := modInst.server(network)
+	if err != nil {
+		return err
+	}
+	id, err := hushcom.NewRequestID()
+	if err != nil {
+		return err
+	}
+	var reg hushcom.WhoisMsg
+	reg.Name = name
+	modInst.keysMutex.Lock()
+	if _, ok := modInst.whoisOut[netKey(net.Name, name)]; ok {
+		modInst.keysMutex.Unlock()
+		return nil
+	}
+	modInst.whoisIDs[id] = whoisLookup{network: net.Name, name: name}
+	modInst.whoisOut[netKey(net.Name, name)] = id
+	modInst.whoisSent[name]++
+	modInst.keysMutex.Unlock()
+	if err := modInst.send("Whois", false, net.Name, modInst.CurrentProfileSigKey, net.PubKey, id, reg); err != nil {
+		modInst.whoisAnswered(net.Name, id)
+		return err
+	}
+	time.AfterFunc(whoisTimeout, func() {
+		if _, ok := modInst.whoisAnswered(net.Name, id); ok {
+			log.Println("No answer to Whois " + name + " from " + net.Name)
+			if err := modInst.handleWhoisResp(net.Name, hushcom.WhoisRespMsg{Name: name}); err != nil {
+				log.Println(err.Error())
+			}
+		}
+	})
+	return nil
 }
 
-// NewListChansMsg - Create a "List Public Channels" message for the Hushcom server
-func (modInst *Client) NewListChansMsg() error {
-	return modInst.HCSend("ListChans", false, HUSHCOM, modInst.CurrentProfilePubKey,
-		HUSHCOMPK, nil)
+// whoisAnswered - forget the unanswered Whois a network's reply with this RequestID is for, false if there's none
+func (modInst *Client) whoisAnswered(network, id string) (whoisLookup, bool) {
+	modInst.keysMutex.Lock()
+	defer modInst.keysMutex.Unlock()
+	lookup, ok := modInst.whoisIDs[id]
+	if !ok || lookup.network != network {
+		return lookup, false
+	}
+	delete(modInst.whoisIDs, id)
+	delete(modInst.whoisOut, netKey(lookup.network, lookup.name))
+	if modInst.whoisSent[lookup.name]--; modInst.whoisSent[lookup.name] <= 0 {
+		delete(modInst.whoisSent, lookup.name)
+	}
+	return lookup, true
 }
 
-// NewNewChanMsg - Create a "register a new channel" message for the Hushcom server
+// NewNewChanMsg - Create a "register a new channel" message for the Hushcom server, using
+// the network, password hash and private flag from the channel's local config
 func (modInst *Client) NewNewChanMsg(chanName string, chanPubKey string) error {
-	if modInst.CurrentProfilePubKey == nil {
-		return errors.New("No profile loaded")
+	network, reg, err := modInst.newChanMsg(chanName, chanPubKey)
+	if err != nil {
+		return err
 	}
+	return modInst.toServer(network, "NewChan", reg)
+}
 
+// newChanMsg - build a NewChan message, and the network it goes to
+func (modInst *Client) newChanMsg(chanName string, chanPubKey string) (string, hushcom.NewChanMsg, error) {
 	var reg hushcom.NewChanMsg
+	if modInst.CurrentProfilePubKey == nil {
+		return "", reg, errors.New("No profile loaded")
+	}
+	cfg, err := modInst.channelConfig(chanName)
+	if err != nil {
+		return "", reg, err
+	}
+
+	chanKey, err := modInst.Node.GetChannelPrivKey(chanName)
+	if err != nil {
+		return "", reg, err
+	}
+	chanSigKey, err := hushcom.ChanSigKey(chanKey)
+	if err != nil {
+		return "", reg, err
+	}
+
+	net, err := modInst.server(cfg.Network)
+	if err != nil {
+		return "", reg, err
+	}
+	if cfg.Network != net.Name {
+		if err := modInst.ClaimChannel(net.Name, chanName); err != nil {
+			return "", reg, err
+		}
+		cfg.Network = net.Name
+		if err := modInst.SetChannelConfig(cfg); err != nil {
+			return "", reg, err
+		}
+	}
+
 	reg.ChanName = chanName
 	reg.ChanPubKey = chanPubKey
-	return modInst.HCSend("NewChan", false, HUSHCOM, modInst.CurrentProfilePubKey, HUSHCOMPK, reg)
+	reg.ChanSigKey = chanSigKey
+	reg.ChanPassword = cfg.Password
+	reg.Private = cfg.Private
+	return cfg.Network, reg, nil
+}
+
+// NewChanJoinedMsg - Tell the Hushcom server we have joined a channel, proving we hold its key
+func (modInst *Client) NewChanJoinedMsg(channel string) error {
+	chanKey, err := modInst.Node.GetChannelPrivKey(channel)
+	if err != nil {
+		return err
+	}
+	proof, err := hushcom.ChanMemberProof(chanKey, channel, modInst.CurrentProfileName)
+	if err != nil {
+		return err
+	}
+	var reg hushcom.ChanJoinedMsg
+	reg.Channel = channel
+	reg.Proof = proof
+	return modInst.toChannelServer(channel, "ChanJoined", reg)
+}
+
+// NewChanPartMsg - Tell the Hushcom server we have left a channel
+func (modInst *Client) NewChanPartMsg(channel string) error {
+	var reg hushcom.ChanPartMsg
+	reg.Channel = channel
+	return modInst.toChannelServer(channel, "ChanPart", reg)
+}
+
+// NewNamesMsg - Ask the Hushcom server for a channel's admins and members
+func (modInst *Client) NewNamesMsg(channel string) error {
+	var reg hushcom.NamesMsg
+	reg.Channel = channel
+	return modInst.toChannelServer(channel, "Names", reg)
+}
+
+// NewChanAdminMsg - Ask the Hushcom server to Kick, Ban, Unban, Op, Deop or TransferOwner a user on a channel
+func (modInst *Client) NewChanAdminMsg(action string, channel string, nick string) error {
+	reg, err := chanAdminMsg(action, channel, nick)
+	if err != nil {
+		return err
+	}
+	return modInst.toChannelServer(channel, action, reg)
+}
+
+func chanAdminMsg(action string, channel string, nick string) (hushcom.ChanAdminMsg, error) {
+	var reg hushcom.ChanAdminMsg
+	known := false
+	for _, a := range hushcom.ChanAdminActions {
+		if a == action {
+			known = true
+		}
+	}
+	if !known {
+		return reg, errors.New("Unknown channel admin action: " + action)
+	}
+	reg.Channel = channel
+	reg.Nick = nick
+	return reg, nil
+}
+
+// handleChanAdminResp - Rotate the channel key after our own kick or ban, forget a channel we were removed from
+func (modInst *Client) handleChanAdminResp(resp hushcom.ChanAdminRespMsg) error {
+	switch {
+	case (resp.Action == "Kick" || resp.Action == "Ban") && resp.By == modInst.CurrentProfileName:
+		// the removed user still holds the current key, so hand a new one to everyone else.
+		// The server won't let a kicked user back in until then.
+		var members []string
+		members = append(members, resp.Admins...)
+		members = append(members, resp.Users...)
+		// not on this goroutine, it has to be free to take the server's answer
+		go func() {
+			if err := modInst.RotateChannelKey(context.Background(), resp.Channel, members); err != nil {
+				log.Println("Could not rotate the key of " + resp.Channel + ": " + err.Error())
+			}
+		}()
+	case (resp.Action == "Kick" || resp.Action == "Ban") && resp.Nick == modInst.CurrentProfileName:
+		return modInst.forgetChannel(resp.Channel)
+	}
+	return nil
+}
+
+// LeaveChannel - Tell the Hushcom server we have left a channel and forget its key
+func (modInst *Client) LeaveChannel(channel string) error {
+	if modInst.CurrentProfilePubKey != nil {
+		if err := modInst.NewChanPartMsg(channel); err != nil {
+			return err
+		}
+	}
+	return modInst.forgetChannel(channel)
+}
+
+// GetChannelMembers - Last known admins and members of a channel, from the most recent NamesResp
+func (modInst *Client) GetChannelMembers(channel string) (hushcom.NamesRespMsg, bool) {
+	modInst.membersMutex.Lock()
+	defer modInst.membersMutex.Unlock()
+	names, ok := modInst.chanMembers[channel]
+	return names, ok
 }
 
 // Client-Handled Messages:
 // - NewJoinChanMsg: Create a join channel request
 // - NewJoinChanRespMsg: Create a join channel response
 
-// NewJoinChanMsg - Create a join channel request
-func (modInst *Client) NewJoinChanMsg(channelName string, channelPubKey bc.PubKey,
-	password string) error {
+// NewJoinChanMsg - Create a join channel request, for a channel listed on a network's server.
+// The responder is the channel admin asked to answer it. If it's empty, the channel owner from the
+// last NamesResp is asked, or else from the server, which only lists a private channel's members to them.
+func (modInst *Client) NewJoinChanMsg(ctx context.Context, network string, channelName string, channelPubKey bc.PubKey,
+	password string, responder string) error {
 
+	net, err := modInst.server(network)
+	if err != nil {
+		return err
+	}
+	if err := modInst.ClaimChannel(net.Name, channelName); err != nil {
+		return err
+	}
+	if err := modInst.SetChannelConfig(&ChannelConfig{Name: channelName, Network: net.Name}); err != nil {
+		return err
+	}
 	var reg hushcom.JoinChanMsg
 	reg.Channel = channelName
 	reg.ReqPubKey = modInst.CurrentProfilePubKey.ToB64()
+	reg.ReqSigKey = hushcom.SigKeyToB64(modInst.CurrentProfileSigKey.Public().(ed25519.PublicKey))
 	reg.Password = password
+	reg.Responder = responder
+	if names, ok := modInst.GetChannelMembers(channelName); ok && reg.Responder == "" {
+		reg.Responder = names.Owner
+	}
+	if reg.Responder == "" {
+		names, err := modInst.ChannelMembers(ctx, channelName)
+		if err != nil {
+			return errors.New("No responder given for " + channelName + " and its owner isn't known: " + err.Error())
+		}
+		reg.Responder = names.Owner
+	}
+
+	// only a JoinChanResp for a join we asked for is taken, a newer request replaces an older one
+	modInst.joinsMutex.Lock()
+	modInst.joinsOut[channelName] = JoinRequest{Network: net.Name, Channel: channelName,
+		From: modInst.CurrentProfileName, Responder: reg.Responder}
+	modInst.joinsMutex.Unlock()
 
 	return modInst.HCSend("JoinChan", true, channelName,
-		modInst.CurrentProfilePubKey, channelPubKey, reg)
+		modInst.CurrentProfileSigKey, channelPubKey, reg)
+}
+
+// joinNetwork - the network of our unanswered join request for a channel, empty if there's none
+func (modInst *Client) joinNetwork(channel string) string {
+	modInst.joinsMutex.Lock()
+	defer modInst.joinsMutex.Unlock()
+	return modInst.joinsOut[channel].Network
 }
 
 // NewJoinChanRespMsg - Create a join channel response
 func (modInst *Client) NewJoinChanRespMsg(channelName string, channelPrivKeyB64 string,
 	userName string, destKey bc.PubKey) error {
 
+	cfg, err := modInst.channelConfig(channelName)
+	if err != nil {
+		return err
+	}
 	var reg hushcom.JoinChanRespMsg
+	reg.Channel = channelName
 	reg.ChannelKey = channelPrivKeyB64
+	reg.ChanPassword = cfg.Password
+	reg.Private = cfg.Private
 	return modInst.HCSend("JoinChanResp", false, userName,
-		modInst.CurrentProfilePubKey, destKey, reg)
+		modInst.CurrentProfileSigKey, destKey, reg)
+}
+
+// sendJoinChanResp - Send the channel key to a requester, or tell them they were denied
+func (modInst *Client) sendJoinChanResp(req JoinRequest, denied bool) error {
+	if denied {
+		var reg hushcom.JoinChanRespMsg
+		reg.Channel = req.Channel
+		reg.Denied = true
+		return modInst.HCSend("JoinChanResp", false, req.From,
+			modInst.CurrentProfileSigKey, req.Key, reg)
+	}
+	result, err := modInst.Node.GetChannelPrivKey(req.Channel)
+	if err != nil {
+		return err
+	}
+	return modInst.NewJoinChanRespMsg(req.Channel, result, req.From, req.Key)
+}
+
+// JoinRequest - A join request for a private channel, waiting on approval
+type JoinRequest struct {
+	Network   string
+	Channel   string
+	From      string
+	Responder string    `json:",omitempty"` // member asked to answer, see hushcom.JoinChanMsg
+	Key       bc.PubKey `json:"-"`
+}
+
+func joinKey(channel, from string) string {
+	return channel + "\x00" + from
+}
+
+// allowJoin - a user's JoinChan for a channel isn't coming too soon after their last one.
+// Each one answered can cost a password check.
+func (modInst *Client) allowJoin(channel, from string, now time.Time) bool {
+	modInst.joinsMutex.Lock()
+	defer modInst.joinsMutex.Unlock()
+	if last, ok := modInst.joinTimes[joinKey(channel, from)]; ok && now.Sub(last) < joinInterval {
+		return false
+	}
+	if len(modInst.joinTimes) >= maxJoinTimes {
+		for k, last := range modInst.joinTimes {
+			if now.Sub(last) >= joinInterval {
+				delete(modInst.joinTimes, k)
+			}
+		}
+		if len(modInst.joinTimes) >= maxJoinTimes {
+			return false
+		}
+	}
+	modInst.joinTimes[joinKey(channel, from)] = now
+	return true
+}
+
+// joinCheck - a JoinChan waiting on the server's member list
+type joinCheck struct {
+	req      JoinRequest
+	password string
+}
+
+// checkJoin - hold a JoinChan and ask the server who the channel's admins and bans are,
+// see answerJoins. Our own copy may be stale, and only lists bans if we were an admin.
+func (modInst *Client) checkJoin(req JoinRequest, password string) error {
+	modInst.joinsMutex.Lock()
+	if len(modInst.joinChecks) >= maxJoinTimes {
+		modInst.joinsMutex.Unlock()
+		return errors.New("Too many join requests waiting, JoinChan from " + req.From + " dropped")
+	}
+	modInst.joinChecks[joinKey(req.Channel, req.From)] = joinCheck{req: req, password: password}
+	modInst.joinsMutex.Unlock()
+	return modInst.NewNamesMsg(req.Channel)
+}
+
+// answerJoins - answer the join requests for a channel held by checkJoin. Only an admin
+// answers, and a user the server lists as banned is denied.
+func (modInst *Client) answerJoins(names hushcom.NamesRespMsg) error {
+	var checks []joinCheck
+	modInst.joinsMutex.Lock()
+	for k, check := range modInst.joinChecks {
+		if check.req.Channel == names.Channel {
+			checks = append(checks, check)
+			delete(modInst.joinChecks, k)
+		}
+	}
+	modInst.joinsMutex.Unlock()
+	if len(checks) == 0 {
+		return nil
+	}
+	if !inList(names.Admins, modInst.CurrentProfileName) {
+		log.Println("Asked to answer join requests for " + names.Channel + ", which we're not an admin of")
+		return nil
+	}
+	for _, check := range checks {
+		var err error
+		if inList(names.Bans, check.req.From) {
+			log.Println("JoinChan from " + check.req.From + " to " + check.req.Channel + " is banned")
+			err = modInst.sendJoinChanResp(check.req, true)
+		} else {
+			err = modInst.answerJoin(check.req, check.password)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// answerJoin - answer a join request from a user who isn't banned
+func (modInst *Client) answerJoin(req JoinRequest, password string) error {
+	cfg, err := modInst.channelConfig(req.Channel)
+	if err != nil {
+		return err
+	}
+	if cfg.Private {
+		// hold the request until a member approves or denies it
+		modInst.joinsMutex.Lock()
+		modInst.pendingJoins[joinKey(req.Channel, req.From)] = req
+		modInst.joinsMutex.Unlock()
+
+		return modInst.emit(req)
+	}
+	if cfg.Password != "" && !hushcom.CheckPassword(cfg.Password, password) {
+		log.Println("JoinChan from " + req.From + " to " + req.Channel + " has a bad password")
+		return modInst.sendJoinChanResp(req, true)
+	}
+	log.Println("Sending JoinChanResp with:")
+	log.Println("   From:\t", req.From)
+	log.Println("   DestKey:\t", req.Key.ToB64())
+	return modInst.sendJoinChanResp(req, false)
+}
+
+func inList(list []string, name string) bool {
+	for _, v := range list {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// GetJoinRequests - List join requests waiting on approval, for one channel or all if channel is empty
+func (modInst *Client) GetJoinRequests(channel string) []JoinRequest {
+	modInst.joinsMutex.Lock()
+	defer modInst.joinsMutex.Unlock()
+	var reqs []JoinRequest
+	for _, req := range modInst.pendingJoins {
+		if channel == "" || req.Channel == channel {
+			reqs = append(reqs, req)
+		}
+	}
+	return reqs
+}
+
+// AnswerJoinRequest - Approve (send the channel key) or deny a pending join request
+func (modInst *Client) AnswerJoinRequest(channel, from string, approve bool) error {
+	modInst.joinsMutex.Lock()
+	req, ok := modInst.pendingJoins[joinKey(channel, from)]
+	delete(modInst.pendingJoins, joinKey(channel, from))
+	modInst.joinsMutex.Unlock()
+	if !ok {
+		return errors.New("No pending join request from " + from + " for " + channel)
+	}
+	return modInst.sendJoinChanResp(req, !approve)
+}
+
+// NewPrivMsg - Send a private message to a user, looking up their key on the network's server if needed
+func (modInst *Client) NewPrivMsg(network string, to string, text string) error {
+	if modInst.CurrentProfilePubKey == nil {
+		return errors.New("No profile loaded")
+	}
+	var reg hushcom.PrivMsg
+	reg.To = to
+	reg.Text = text
+	return modInst.sendToUser(network, to, "PrivMsg", reg)
+}
+
+// RotateChannelKey - Generate a new channel key and register it with the Hushcom server, which only
+// accepts this from a channel admin. Once it has, switch to the new key and hand it to each remaining
+// member. If members is empty, the last known member list from NamesResp is used.
+func (modInst *Client) RotateChannelKey(ctx context.Context, channel string, members []string) error {
+	if modInst.CurrentProfilePubKey == nil {
+		return errors.New("No profile loaded")
+	}
+	if len(members) == 0 {
+		if names, ok := modInst.GetChannelMembers(channel); ok {
+			members = append(members, names.Admins...)
+			members = append(members, names.Users...)
+		}
+	}
+	seen := make(map[string]bool)
+	network := modInst.channelNetwork(channel)
+	oldKey, err := modInst.Node.GetChannelPrivKey(channel)
+	if err != nil {
+		return err
+	}
+	if oldKey == "" {
+		return errors.New("Not a member of channel " + channel)
+	}
+	chanCrypt := new(ecc.KeyPair)
+	chanCrypt.GenerateKey()
+	newKey := chanCrypt.ToB64()
+	proof, err := hushcom.ChanKeyProof(oldKey, newKey)
+	if err != nil {
+		return err
+	}
+
+	// registered first, members check with the server before they take the new key
+	chanSigKey, err := hushcom.ChanSigKey(newKey)
+	if err != nil {
+		return err
+	}
+	var rot hushcom.RotateChanKeyMsg
+	rot.ChanName = channel
+	rot.ChanPubKey = chanCrypt.GetPubKey().ToB64()
+	rot.ChanSigKey = chanSigKey
+	var resp hushcom.RotateChanKeyRespMsg
+	if err := modInst.requestInto(ctx, network, "RotateChanKey", rot, "RotateChanKeyResp", &resp); err != nil {
+		return err
+	}
+	if err := modInst.switchChannelKey(network, channel, oldKey, newKey); err != nil {
+		return err
+	}
+
+	var reg hushcom.ChanKeyMsg
+	reg.Channel = channel
+	reg.ChannelKey = newKey
+	reg.Proof = proof
+	for _, member := range members {
+		if member == modInst.CurrentProfileName || seen[member] {
+			continue
+		}
+		seen[member] = true
+		if err := modInst.sendToUser(network, member, "ChanKey", reg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SendChannelMsg - Post a message to a channel and store it in the local history
+func (modInst *Client) SendChannelMsg(channel string, text string) error {
+	var req hushcom.ChannelMsg
+	req.Channel = channel
+	req.Text = text
+	if err := modInst.HCSend("Channel", true, channel, modInst.CurrentProfileSigKey, nil, req); err != nil {
+		return err
+	}
+	return modInst.addHistory(modInst.channelNetwork(channel), channel, modInst.CurrentProfileName, text, time.Now())
 }
 
 // HCSend - Send message via this client instance
 func (modInst *Client) HCSend(
 	msgType string, channel bool, to string,
-	signKey bc.PubKey, destKey bc.PubKey, hcmsg interface{}) error {
+	signKey ed25519.PrivateKey, destKey bc.PubKey, hcmsg interface{}) error {
+
+	return modInst.send(msgType, channel, to, signKey, destKey, "", hcmsg)
+}
+
+// send - HCSend, with an optional RequestID
+func (modInst *Client) send(
+	msgType string, channel bool, to string,
+	signKey ed25519.PrivateKey, destKey bc.PubKey, requestID string, hcmsg interface{}) error {
 
 	var err error
 	var msg hushcom.Msg
 	msg.From = modInst.CurrentProfileName
 	msg.MsgType = msgType
 	msg.Timestamp = time.Now().UTC().UnixNano()
+	msg.RequestID = requestID
 
 	if hcmsg != nil {
 		jsonb, err := json.Marshal(hcmsg)
@@ -0,0 +1,603 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"database/sql"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/awgh/bencrypt/bc"
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/hushcom"
+	"github.com/awgh/hushcom/server"
+	"github.com/awgh/ratnet/api"
+	_ "modernc.org/ql/driver"
+)
+
+const testServerName = "TestServer"
+
+// testDB - a fresh QL database, opened anew for each caller as ratnet does
+func testDB(t *testing.T) func() *sql.DB {
+	path := t.TempDir() + "/ratnet.ql"
+	return func() *sql.DB {
+		c, err := sql.Open("ql2", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+}
+
+// profileClient - a client with a profile named name and no network, for what only touches the database
+func profileClient(t *testing.T, name string) *Client {
+	c := New(nil, testDB(t))
+	profile := new(ecc.KeyPair)
+	profile.GenerateKey()
+	histKey, err := historyKey(profile.ToB64())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.CurrentProfileName = name
+	c.CurrentProfilePubKey = profile.GetPubKey()
+	c.historyKey = histKey
+	return c
+}
+
+// testNet - an in-memory ratnet with one Hushcom server and the clients talking to it.
+// Messages are handed over one at a time, in order, on a goroutine of their own.
+type testNet struct {
+	t       *testing.T
+	server  *server.Server
+	srvKey  *ecc.KeyPair
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	queue   []func()
+	busy    bool
+	done    bool
+	clients []*Client
+}
+
+func newTestNet(t *testing.T) *testNet {
+	n := &testNet{t: t}
+	n.cond = sync.NewCond(&n.mutex)
+
+	n.srvKey = new(ecc.KeyPair)
+	n.srvKey.GenerateKey()
+	db := testDB(t)
+	c := db()
+	tx, err := c.Begin()
+	if err == nil {
+		_, err = tx.Exec("CREATE TABLE config (name string, value string);")
+	}
+	if err == nil {
+		_, err = tx.Exec("INSERT INTO config VALUES( `contentkey`, $1 );", n.srvKey.ToB64())
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.server = server.New(&testNode{net: n, name: testServerName}, db)
+	if err := n.server.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	go n.run()
+	t.Cleanup(func() {
+		n.mutex.Lock()
+		n.done = true
+		n.cond.Broadcast()
+		n.mutex.Unlock()
+	})
+	return n
+}
+
+func (n *testNet) run() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for {
+		for len(n.queue) == 0 && !n.done {
+			n.cond.Wait()
+		}
+		if n.done {
+			return
+		}
+		deliver := n.queue[0]
+		n.queue = n.queue[1:]
+		n.busy = true
+		n.mutex.Unlock()
+		deliver()
+		n.mutex.Lock()
+		n.busy = false
+		n.cond.Broadcast()
+	}
+}
+
+func (n *testNet) post(deliver func()) {
+	n.mutex.Lock()
+	n.queue = append(n.queue, deliver)
+	n.cond.Broadcast()
+	n.mutex.Unlock()
+}
+
+// settle - wait until every message sent so far, and every one sent while handling those, is handled
+func (n *testNet) settle() {
+	n.mutex.Lock()
+	for len(n.queue) > 0 || n.busy {
+		n.cond.Wait()
+	}
+	n.mutex.Unlock()
+}
+
+// serverSigKey - b64 signing pubkey of the test server
+func (n *testNet) serverSigKey() string {
+	sk, err := hushcom.SigningKey(n.srvKey.ToB64())
+	if err != nil {
+		n.t.Fatal(err)
+	}
+	return hushcom.SigKeyToB64(sk.Public().(ed25519.PublicKey))
+}
+
+// newClient - a new client with a profile named nick, connected to the test server but not registered
+func (n *testNet) newClient(nick string) *Client {
+	c := New(&testNode{net: n, name: nick, channels: make(map[string]string), out: make(chan api.Msg, 4)}, testDB(n.t))
+	profile := new(ecc.KeyPair)
+	profile.GenerateKey()
+	sigKey, err := hushcom.SigningKey(profile.ToB64())
+	if err != nil {
+		n.t.Fatal(err)
+	}
+	histKey, err := historyKey(profile.ToB64())
+	if err != nil {
+		n.t.Fatal(err)
+	}
+	c.CurrentProfileName = nick
+	c.CurrentProfilePubKey = profile.GetPubKey()
+	c.CurrentProfileSigKey = sigKey
+	c.historyKey = histKey
+	if err := c.SetServer(&ServerConfig{Name: testServerName, PubKey: n.srvKey.GetPubKey().ToB64(),
+		SigKey: n.serverSigKey()}); err != nil {
+		n.t.Fatal(err)
+	}
+	n.mutex.Lock()
+	n.clients = append(n.clients, c)
+	n.mutex.Unlock()
+	return c
+}
+
+// client - a new client registered with the test server
+func (n *testNet) client(nick string) *Client {
+	c := n.newClient(nick)
+	if err := c.Register(context.Background(), ""); err != nil {
+		n.t.Fatal(err)
+	}
+	return c
+}
+
+// send - hand a message to the server or a client: the one holding pubkey if there is one, else the one named to
+func (n *testNet) send(to string, data []byte, pubkey []bc.PubKey) {
+	data = append([]byte(nil), data...)
+	n.post(func() {
+		if to == testServerName {
+			n.server.HandleMsg(api.Msg{Content: bytes.NewBuffer(data)})
+			return
+		}
+		n.mutex.Lock()
+		clients := n.clients
+		n.mutex.Unlock()
+		for _, c := range clients {
+			if len(pubkey) > 0 && c.CurrentProfilePubKey.ToB64() == pubkey[0].ToB64() ||
+				len(pubkey) == 0 && c.CurrentProfileName == to {
+				c.HandleMsg(api.Msg{Name: "[content]", Content: bytes.NewBuffer(data)})
+				return
+			}
+		}
+	})
+}
+
+// sendChannel - route a channel message, encrypted to pubkey or else the sender's channel key,
+// at every other client through a Router, as their nodes would
+func (n *testNet) sendChannel(from *testNode, channel string, data []byte, pubkey []bc.PubKey) {
+	sender := new(ecc.KeyPair)
+	sender.GenerateKey()
+	if len(pubkey) == 0 {
+		if err := sender.FromB64(from.channel(channel)); err != nil {
+			n.t.Error(err)
+			return
+		}
+		pubkey = []bc.PubKey{sender.GetPubKey()}
+	}
+	ciphertext, err := sender.EncryptMessage(data, pubkey[0])
+	if err != nil {
+		n.t.Error(err)
+		return
+	}
+	message := append([]byte{api.ChannelFlag, byte(len(channel) >> 8), byte(len(channel))}, channel...)
+	message = append(message, ciphertext...)
+	n.post(func() {
+		n.mutex.Lock()
+		clients := n.clients
+		n.mutex.Unlock()
+		for _, c := range clients {
+			node := c.Node.(*testNode)
+			if node == from {
+				continue
+			}
+			if err := NewRouter(testRouter{}, c).Route(node, message); err != nil {
+				n.t.Error(err)
+			}
+			for len(node.out) > 0 {
+				c.HandleMsg(<-node.out)
+			}
+		}
+	})
+}
+
+// testRouter - hands on the channel messages a testNode's current channel keys open
+type testRouter struct {
+	api.Router
+}
+
+func (testRouter) Route(node api.Node, message []byte) error {
+	n := 3 + (int(message[1])<<8 | int(message[2]))
+	priv := node.(*testNode).channel(string(message[3:n]))
+	if priv == "" {
+		return nil
+	}
+	key := new(ecc.KeyPair)
+	if err := key.FromB64(priv); err != nil {
+		return err
+	}
+	if ok, clear, err := key.DecryptMessage(message[n:]); ok && err == nil {
+		node.Out() <- api.Msg{Name: string(message[3:n]), IsChan: true, Content: bytes.NewBuffer(clear)}
+	}
+	return nil
+}
+
+// testNode - the parts of a ratnet node Hushcom uses, on a testNet
+type testNode struct {
+	api.Node
+	net      *testNet
+	name     string
+	mutex    sync.Mutex
+	channels map[string]string // private keys, by channel
+	out      chan api.Msg
+}
+
+func (node *testNode) Out() chan api.Msg {
+	return node.out
+}
+
+func (node *testNode) AddContact(name string, key string) error {
+	return nil
+}
+
+func (node *testNode) channel(name string) string {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	return node.channels[name]
+}
+
+func (node *testNode) GetChannelPrivKey(name string) (string, error) {
+	return node.channel(name), nil
+}
+
+func (node *testNode) AddChannel(name string, privkey string) error {
+	node.mutex.Lock()
+	node.channels[name] = privkey
+	node.mutex.Unlock()
+	return nil
+}
+
+func (node *testNode) DeleteChannel(name string) error {
+	node.mutex.Lock()
+	delete(node.channels, name)
+	node.mutex.Unlock()
+	return nil
+}
+
+func (node *testNode) Send(contactName string, data []byte, pubkey ...bc.PubKey) error {
+	node.net.send(contactName, data, pubkey)
+	return nil
+}
+
+func (node *testNode) SendChannel(channelName string, data []byte, pubkey ...bc.PubKey) error {
+	node.net.sendChannel(node, channelName, data, pubkey)
+	return nil
+}
+
+// createChannel - make a channel owned by c, as PUT /v1/remote/channel does
+func (n *testNet) createChannel(c *Client, name string, cfg ChannelConfig) bc.PubKey {
+	cfg.Name = name
+	cfg.Network = testServerName
+	if err := c.ClaimChannel(testServerName, name); err != nil {
+		n.t.Fatal(err)
+	}
+	if err := c.SetChannelConfig(&cfg); err != nil {
+		n.t.Fatal(err)
+	}
+	key := new(ecc.KeyPair)
+	key.GenerateKey()
+	if err := c.Node.AddChannel(name, key.ToB64()); err != nil {
+		n.t.Fatal(err)
+	}
+	if err := c.CreateChannel(context.Background(), name, key.GetPubKey().ToB64()); err != nil {
+		n.t.Fatal(err)
+	}
+	return key.GetPubKey()
+}
+
+// joinChannel - ask to join a channel and wait for the answer
+func (n *testNet) joinChannel(c *Client, name string, pubkey bc.PubKey, password, responder string) {
+	if err := c.NewJoinChanMsg(context.Background(), testServerName, name, pubkey, password, responder); err != nil {
+		n.t.Fatal(err)
+	}
+	n.settle()
+}
+
+// chanKey - the key c holds for a channel, empty if none
+func chanKey(c *Client, channel string) string {
+	key, _ := c.Node.GetChannelPrivKey(channel)
+	return key
+}
+
+func TestWhois(t *testing.T) {
+	n := newTestNet(t)
+	alice := n.client("alice")
+	bob := n.client("bob")
+
+	resp, err := alice.Whois(context.Background(), "", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobSigKey := hushcom.SigKeyToB64(bob.CurrentProfileSigKey.Public().(ed25519.PublicKey))
+	if !resp.Found || resp.Key != bob.CurrentProfilePubKey.ToB64() || resp.SigKey != bobSigKey {
+		t.Fatalf("Whois bob: %+v", resp)
+	}
+	// pinned by the time the answer is back
+	pin, err := alice.GetContactKey(testServerName, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pin == nil || pin.SigKey != bobSigKey {
+		t.Errorf("bob's keys pinned as %+v", pin)
+	}
+
+	resp, err = alice.Whois(context.Background(), "", "carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Found {
+		t.Errorf("Whois of an unregistered user: %+v", resp)
+	}
+}
+
+func TestRotateChannelKey(t *testing.T) {
+	n := newTestNet(t)
+	alice := n.client("alice")
+	bob := n.client("bob")
+	pubkey := n.createChannel(alice, "#a", ChannelConfig{})
+	n.joinChannel(bob, "#a", pubkey, "", "")
+	oldKey := chanKey(alice, "#a")
+	if chanKey(bob, "#a") != oldKey {
+		t.Fatal("bob didn't get the channel key")
+	}
+
+	// bob isn't an admin, the server refuses and he keeps the key everyone else has
+	err := bob.RotateChannelKey(context.Background(), "#a", []string{"alice"})
+	var rerr *RequestError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("rotation by a non-admin: got %v, want a RequestError", err)
+	}
+	n.settle()
+	if chanKey(bob, "#a") != oldKey || chanKey(alice, "#a") != oldKey {
+		t.Fatal("channel key changed after a refused rotation")
+	}
+
+	if err := alice.RotateChannelKey(context.Background(), "#a", []string{"bob"}); err != nil {
+		t.Fatal(err)
+	}
+	n.settle()
+	newKey := chanKey(alice, "#a")
+	if newKey == oldKey {
+		t.Fatal("alice is still on the old key")
+	}
+	if chanKey(bob, "#a") != newKey {
+		t.Error("bob didn't take the rotated key")
+	}
+}
+
+func TestRetiredChannelKey(t *testing.T) {
+	n := newTestNet(t)
+	alice := n.client("alice")
+	bob := n.client("bob")
+	carol := n.client("carol")
+	pubkey := n.createChannel(alice, "#a", ChannelConfig{})
+	n.joinChannel(bob, "#a", pubkey, "", "")
+	n.joinChannel(carol, "#a", pubkey, "", "")
+	oldKey := chanKey(alice, "#a")
+
+	// only carol is handed the new key, bob keeps sending under the old one for now
+	if err := alice.RotateChannelKey(context.Background(), "#a", []string{"carol"}); err != nil {
+		t.Fatal(err)
+	}
+	n.settle()
+	if chanKey(alice, "#a") == oldKey || chanKey(carol, "#a") != chanKey(alice, "#a") {
+		t.Fatal("rotated key not taken by alice and carol")
+	}
+	if chanKey(bob, "#a") != oldKey {
+		t.Fatal("bob took the rotated key without being sent it")
+	}
+	if err := bob.SendChannelMsg("#a", "still on the old key"); err != nil {
+		t.Fatal(err)
+	}
+	n.settle()
+	for _, c := range []*Client{alice, carol} {
+		h, err := c.GetHistory(testServerName, "#a", 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(h) == 0 || h[0].From != "bob" || h[0].Text != "still on the old key" {
+			t.Errorf("%s's history after bob wrote under the retired key: %+v", c.CurrentProfileName, h)
+		}
+	}
+
+	keys, err := alice.GetRetiredChannelKeys(testServerName, "#a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != oldKey {
+		t.Fatalf("retired keys %v, want the old key", keys)
+	}
+	c := alice.DB()
+	defer c.Close()
+	var data []byte
+	if err := c.QueryRow("SELECT data FROM hc_chan_keys;").Scan(&data); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte(oldKey)) {
+		t.Error("retired key stored in the clear")
+	}
+
+	// another profile on the same database sees none of them
+	alice.CurrentProfileName = "mallory"
+	if keys, err := alice.GetRetiredChannelKeys(testServerName, "#a"); err != nil || len(keys) != 0 {
+		t.Errorf("another profile's retired keys: %v %v", keys, err)
+	}
+}
+
+func TestJoinChanBanned(t *testing.T) {
+	n := newTestNet(t)
+	alice := n.client("alice")
+	bob := n.client("bob")
+	carol := n.client("carol")
+	dave := n.client("dave")
+	pubkey := n.createChannel(alice, "#a", ChannelConfig{})
+	n.joinChannel(bob, "#a", pubkey, "", "")
+	n.joinChannel(dave, "#a", pubkey, "", "")
+	if chanKey(bob, "#a") == "" || chanKey(dave, "#a") == "" {
+		t.Fatal("bob and dave weren't let in by the owner")
+	}
+	ctx := context.Background()
+	if _, err := alice.AdminChannel(ctx, "Op", "#a", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	// the ban comes after bob was made an admin, so bob's copy of the member list doesn't have it
+	if _, err := alice.AdminChannel(ctx, "Ban", "#a", "carol"); err != nil {
+		t.Fatal(err)
+	}
+	n.settle()
+
+	for _, responder := range []string{"", "bob", "dave"} {
+		n.joinChannel(carol, "#a", pubkey, "", responder)
+		if chanKey(carol, "#a") != "" {
+			t.Fatalf("banned carol was handed the key, asking %q", responder)
+		}
+	}
+
+	// a member who isn't an admin doesn't answer anyone
+	erin := n.client("erin")
+	n.joinChannel(erin, "#a", pubkey, "", "dave")
+	if chanKey(erin, "#a") != "" {
+		t.Error("dave let erin in without being an admin")
+	}
+	n.joinChannel(erin, "#a", pubkey, "", "bob")
+	if chanKey(erin, "#a") == "" {
+		t.Error("admin bob didn't let erin in")
+	}
+}
+
+func TestJoinChanPinsServerKeys(t *testing.T) {
+	n := newTestNet(t)
+	alice := n.client("alice")
+	bob := n.client("bob")
+	pubkey := n.createChannel(alice, "#a", ChannelConfig{})
+
+	// mallory signs a JoinChan as bob with keys of their own, before alice has pinned bob's
+	mallory := n.newClient("bob")
+	n.joinChannel(mallory, "#a", pubkey, "", "alice")
+	if chanKey(mallory, "#a") != "" {
+		t.Fatal("a JoinChan with someone else's name was let in")
+	}
+	bobSigKey := hushcom.SigKeyToB64(bob.CurrentProfileSigKey.Public().(ed25519.PublicKey))
+	pin, err := alice.GetContactKey(testServerName, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pin == nil || pin.SigKey != bobSigKey {
+		t.Fatalf("bob pinned as %+v, want the keys the server has", pin)
+	}
+
+	n.joinChannel(bob, "#a", pubkey, "", "alice")
+	if chanKey(bob, "#a") == "" {
+		t.Error("the real bob wasn't let in")
+	}
+}
+
+func TestJoinChanPassword(t *testing.T) {
+	n := newTestNet(t)
+	alice := n.client("alice")
+	bob := n.client("bob")
+	carol := n.client("carol")
+	hash, err := hushcom.HashPassword("sesame")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubkey := n.createChannel(alice, "#a", ChannelConfig{Password: hash})
+
+	n.joinChannel(bob, "#a", pubkey, "open up", "")
+	if chanKey(bob, "#a") != "" {
+		t.Error("let in with the wrong password")
+	}
+	n.joinChannel(carol, "#a", pubkey, "sesame", "")
+	if chanKey(carol, "#a") == "" {
+		t.Error("not let in with the right password")
+	}
+}
+
+func TestJoinChanApproval(t *testing.T) {
+	n := newTestNet(t)
+	alice := n.client("alice")
+	bob := n.client("bob")
+	carol := n.client("carol")
+	pubkey := n.createChannel(alice, "#a", ChannelConfig{Private: true})
+
+	// the members of a private channel aren't listed to outsiders, so the responder has to be given
+	if err := bob.NewJoinChanMsg(context.Background(), testServerName, "#a", pubkey, "", ""); err == nil {
+		t.Error("join of a private channel sent without a responder")
+	}
+
+	n.joinChannel(bob, "#a", pubkey, "", "alice")
+	n.joinChannel(carol, "#a", pubkey, "", "alice")
+	if chanKey(bob, "#a") != "" || chanKey(carol, "#a") != "" {
+		t.Fatal("let in before approval")
+	}
+	if reqs := alice.GetJoinRequests("#a"); len(reqs) != 2 {
+		t.Fatalf("join requests %+v, want bob's and carol's", reqs)
+	}
+
+	if err := alice.AnswerJoinRequest("#a", "bob", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.AnswerJoinRequest("#a", "carol", false); err != nil {
+		t.Fatal(err)
+	}
+	n.settle()
+	if chanKey(bob, "#a") == "" {
+		t.Error("bob not let in after approval")
+	}
+	if chanKey(carol, "#a") != "" {
+		t.Error("carol let in after denial")
+	}
+	if reqs := alice.GetJoinRequests(""); len(reqs) != 0 {
+		t.Errorf("join requests left after answering: %+v", reqs)
+	}
+	if err := alice.AnswerJoinRequest("#a", "carol", true); err == nil {
+		t.Error("answered a join request twice")
+	}
+}
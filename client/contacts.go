@@ -0,0 +1,243 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/awgh/bencrypt/bc"
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/hushcom"
+)
+
+// ContactKey - A user's keys, pinned the first time the current profile saw them on a network
+type ContactKey struct {
+	Network     string
+	Name        string
+	Key         string // b64 content pubkey
+	SigKey      string // b64 signing pubkey
+	Fingerprint string // of SigKey
+	FirstSeen   time.Time
+	Verified    bool // confirmed out of band by the user
+}
+
+// KeyChanged - A user showed up with keys that differ from their pinned ones.
+// The pinned keys stay in use until the pin is reset.
+type KeyChanged struct {
+	Network        string
+	Name           string
+	OldFingerprint string
+	NewFingerprint string
+	WasVerified    bool
+}
+
+// Resp - Wire form of a KeyChanged
+func (e KeyChanged) Resp() JSONResp {
+	return JSONResp{MsgType: "KeyChanged", From: e.Name, Network: e.Network, Data: e}
+}
+
+// pinKeys - trust on first use: pin a user's keys the first time we see them on a network. After that
+// the pinned keys are returned instead, with changed set and a KeyChanged event if they differ.
+func (modInst *Client) pinKeys(network, name string, key bc.PubKey, sigKey ed25519.PublicKey) (bc.PubKey, ed25519.PublicKey, bool, error) {
+	pin, err := modInst.GetContactKey(network, name)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if pin == nil {
+		pin = &ContactKey{Network: network, Name: name, Key: key.ToB64(), SigKey: hushcom.SigKeyToB64(sigKey),
+			Fingerprint: hushcom.Fingerprint(sigKey), FirstSeen: time.Now()}
+		return key, sigKey, false, modInst.saveContactKey(pin)
+	}
+	if pin.Key == key.ToB64() && pin.SigKey == hushcom.SigKeyToB64(sigKey) {
+		return key, sigKey, false, nil
+	}
+	pinnedKey := new(ecc.PubKey)
+	if err := pinnedKey.FromB64(pin.Key); err != nil {
+		return nil, nil, false, err
+	}
+	pinnedSigKey, err := hushcom.SigKeyFromB64(pin.SigKey)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	ev := KeyChanged{Network: network, Name: name, OldFingerprint: pin.Fingerprint,
+		NewFingerprint: hushcom.Fingerprint(sigKey), WasVerified: pin.Verified}
+	return pinnedKey, pinnedSigKey, true, modInst.emit(ev)
+}
+
+// loadContactKeys - use the current profile's pinned keys without asking the server
+func (modInst *Client) loadContactKeys() error {
+	pins, err := modInst.GetContactKeys()
+	if err != nil {
+		return err
+	}
+	modInst.keysMutex.Lock()
+	defer modInst.keysMutex.Unlock()
+	for _, pin := range pins {
+		k := new(ecc.PubKey)
+		if err := k.FromB64(pin.Key); err != nil {
+			return err
+		}
+		sk, err := hushcom.SigKeyFromB64(pin.SigKey)
+		if err != nil {
+			return err
+		}
+		modInst.userKeys[netKey(pin.Network, pin.Name)] = k
+		modInst.sigKeys[netKey(pin.Network, pin.Name)] = sk
+	}
+	return nil
+}
+
+func scanContactKey(scan func(...interface{}) error) (*ContactKey, error) {
+	pin := new(ContactKey)
+	var firstSeen int64
+	if err := scan(&pin.Network, &pin.Name, &pin.Key, &pin.SigKey, &firstSeen, &pin.Verified); err != nil {
+		return nil, err
+	}
+	sk, err := hushcom.SigKeyFromB64(pin.SigKey)
+	if err != nil {
+		return nil, err
+	}
+	pin.Fingerprint = hushcom.Fingerprint(sk)
+	pin.FirstSeen = time.Unix(0, firstSeen)
+	return pin, nil
+}
+
+// GetContactKeys - Get all of the current profile's pinned keys
+func (modInst *Client) GetContactKeys() ([]*ContactKey, error) {
+	c := modInst.DB()
+	defer c.Close()
+	r, err := c.Query("SELECT network,name,pubkey,sigkey,firstseen,verified FROM hc_contact_keys WHERE profile==$1 ORDER BY network,name;",
+		modInst.CurrentProfileName)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var pins []*ContactKey
+	for r.Next() {
+		pin, err := scanContactKey(r.Scan)
+		if err != nil {
+			return nil, err
+		}
+		pins = append(pins, pin)
+	}
+	return pins, r.Err()
+}
+
+// GetContactKey - Get a user's pinned keys on a network, nil if none are pinned
+func (modInst *Client) GetContactKey(network, name string) (*ContactKey, error) {
+	c := modInst.DB()
+	defer c.Close()
+	row := c.QueryRow("SELECT network,name,pubkey,sigkey,firstseen,verified FROM hc_contact_keys WHERE profile==$1 && network==$2 && name==$3;",
+		modInst.CurrentProfileName, network, name)
+	pin, err := scanContactKey(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return pin, err
+}
+
+func (modInst *Client) saveContactKey(pin *ContactKey) error {
+	c := modInst.DB()
+	defer c.Close()
+	tx, err := c.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM hc_contact_keys WHERE profile==$1 && network==$2 && name==$3;",
+		modInst.CurrentProfileName, pin.Network, pin.Name); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO hc_contact_keys VALUES( $1, $2, $3, $4, $5, $6, $7 );",
+		modInst.CurrentProfileName, pin.Network, pin.Name, pin.Key, pin.SigKey, pin.FirstSeen.UTC().UnixNano(), pin.Verified); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// ContactFingerprint - What two users compare to verify each other's keys
+type ContactFingerprint struct {
+	Network       string
+	Name          string
+	Fingerprint   string // of Name's pinned signing key
+	MyFingerprint string // of the current profile's signing key
+	SafetyNumber  string // same for both users
+	QR            string // SafetyNumber for QR codes
+	Verified      bool
+}
+
+// GetContactFingerprint - Fingerprints and safety number for the current profile and a pinned contact
+func (modInst *Client) GetContactFingerprint(network, name string) (*ContactFingerprint, error) {
+	if modInst.CurrentProfileSigKey == nil {
+		return nil, errors.New("No profile loaded")
+	}
+	pin, err := modInst.GetContactKey(network, name)
+	if err != nil {
+		return nil, err
+	}
+	if pin == nil {
+		return nil, errors.New("No pinned key for " + name + " on " + network)
+	}
+	theirs, err := hushcom.SigKeyFromB64(pin.SigKey)
+	if err != nil {
+		return nil, err
+	}
+	mine := modInst.CurrentProfileSigKey.Public().(ed25519.PublicKey)
+	fp := new(ContactFingerprint)
+	fp.Network = network
+	fp.Name = name
+	fp.Fingerprint = pin.Fingerprint
+	fp.MyFingerprint = hushcom.Fingerprint(mine)
+	fp.SafetyNumber = hushcom.SafetyNumber(modInst.CurrentProfileName, mine, name, theirs)
+	fp.QR = hushcom.SafetyNumberQR(fp.SafetyNumber)
+	fp.Verified = pin.Verified
+	return fp, nil
+}
+
+// VerifyContactKey - Mark a user's pinned keys as confirmed out of band. If safetyNumber
+// is given (digits, or the QR form), it must match the one computed for the pinned keys.
+func (modInst *Client) VerifyContactKey(network, name string, safetyNumber string) error {
+	pin, err := modInst.GetContactKey(network, name)
+	if err != nil {
+		return err
+	}
+	if pin == nil {
+		return errors.New("No pinned key for " + name + " on " + network)
+	}
+	if safetyNumber != "" {
+		fp, err := modInst.GetContactFingerprint(network, name)
+		if err != nil {
+			return err
+		}
+		if normalizeSafetyNumber(safetyNumber) != normalizeSafetyNumber(fp.SafetyNumber) {
+			return errors.New("Safety number for " + name + " does not match")
+		}
+	}
+	pin.Verified = true
+	return modInst.saveContactKey(pin)
+}
+
+func normalizeSafetyNumber(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// ResetContactKey - Forget a user's pinned keys on a network, so the next keys seen for them are pinned instead
+func (modInst *Client) ResetContactKey(network, name string) error {
+	if err := modInst.transactExec("DELETE FROM hc_contact_keys WHERE profile==$1 && network==$2 && name==$3;",
+		modInst.CurrentProfileName, network, name); err != nil {
+		return err
+	}
+	modInst.keysMutex.Lock()
+	delete(modInst.userKeys, netKey(network, name))
+	delete(modInst.sigKeys, netKey(network, name))
+	modInst.keysMutex.Unlock()
+	return nil
+}
@@ -0,0 +1,75 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"testing"
+
+	"github.com/awgh/bencrypt/bc"
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/hushcom"
+)
+
+func newKeys(t *testing.T) (bc.PubKey, ed25519.PublicKey) {
+	t.Helper()
+	k := new(ecc.KeyPair)
+	k.GenerateKey()
+	sk, err := hushcom.SigningKey(k.ToB64())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k.GetPubKey(), sk.Public().(ed25519.PublicKey)
+}
+
+func TestPinKeys(t *testing.T) {
+	c := profileClient(t, "alice")
+	changes := c.Subscribe(EventTypes("KeyChanged"))
+	key, sigKey := newKeys(t)
+	otherKey, otherSigKey := newKeys(t)
+
+	k, sk, changed, err := c.pinKeys("net", "bob", key, sigKey)
+	if err != nil || changed || k.ToB64() != key.ToB64() || !sk.Equal(sigKey) {
+		t.Fatalf("first pin: changed %v err %v", changed, err)
+	}
+	if _, _, changed, err := c.pinKeys("net", "bob", key, sigKey); err != nil || changed {
+		t.Fatalf("same keys again: changed %v err %v", changed, err)
+	}
+
+	// other keys under the same name: the pinned ones are kept, and the user is told
+	k, sk, changed, err = c.pinKeys("net", "bob", otherKey, otherSigKey)
+	if err != nil || !changed || k.ToB64() != key.ToB64() || !sk.Equal(sigKey) {
+		t.Fatalf("changed keys: changed %v err %v, want the pinned keys back", changed, err)
+	}
+	select {
+	case ev := <-changes:
+		kc := ev.(KeyChanged)
+		if kc.Name != "bob" || kc.OldFingerprint != hushcom.Fingerprint(sigKey) || kc.NewFingerprint != hushcom.Fingerprint(otherSigKey) {
+			t.Errorf("KeyChanged %+v", kc)
+		}
+	default:
+		t.Error("no KeyChanged event")
+	}
+	if pin, err := c.GetContactKey("net", "bob"); err != nil || pin.SigKey != hushcom.SigKeyToB64(sigKey) {
+		t.Errorf("pin after a change %+v %v, want the first keys", pin, err)
+	}
+
+	// after a reset the next keys seen are pinned
+	if err := c.ResetContactKey("net", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, changed, err := c.pinKeys("net", "bob", otherKey, otherSigKey); err != nil || changed {
+		t.Errorf("pin after a reset: changed %v err %v", changed, err)
+	}
+	if pin, err := c.GetContactKey("net", "bob"); err != nil || pin.SigKey != hushcom.SigKeyToB64(otherSigKey) {
+		t.Errorf("pin after a reset %+v %v, want the new keys", pin, err)
+	}
+
+	// pins are per network and per profile
+	if _, _, changed, err := c.pinKeys("other", "bob", otherKey, otherSigKey); err != nil || changed {
+		t.Errorf("bob on another network: changed %v err %v", changed, err)
+	}
+	mallory := New(nil, c.DB)
+	mallory.CurrentProfileName = "mallory"
+	if pin, err := mallory.GetContactKey("net", "bob"); err != nil || pin != nil {
+		t.Errorf("another profile sees pin %+v %v", pin, err)
+	}
+}
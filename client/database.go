@@ -0,0 +1,255 @@
+package client
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ChannelConfig - Local settings for a channel this client is a member of
+type ChannelConfig struct {
+	Name     string
+	Password string // salted hash from hushcom.HashPassword, empty if none
+	Private  bool   // joins need approval from a member
+	Network  string // the Hushcom server the channel is registered on
+}
+
+// netKey - map key for a user or channel name on a network. The same name on two
+// networks is two different users or channels.
+func netKey(network, name string) string {
+	return network + "\x00" + name
+}
+
+func (modInst *Client) transactExec(sqlq string, params ...interface{}) error {
+	c := modInst.DB()
+	defer c.Close()
+	tx, err := c.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(sqlq, params...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// bootstrapDB - create hushcom-owned client tables in the ratnet database
+func (modInst *Client) bootstrapDB() error {
+	if err := modInst.transactExec(`
+		CREATE TABLE IF NOT EXISTS hc_chan_config (
+			name		string	NOT NULL,
+			password	string	NOT NULL,
+			private		bool	NOT NULL,
+			network		string	NOT NULL
+		);`); err != nil {
+		return err
+	}
+	if err := modInst.transactExec(`
+		CREATE TABLE IF NOT EXISTS hc_chan_keys (
+			profile		string	NOT NULL,
+			network		string	NOT NULL,
+			channel		string	NOT NULL,
+			data		blob	NOT NULL,
+			retired		int64	NOT NULL
+		);`); err != nil {
+		return err
+	}
+	// sender and text are encrypted with the profile's history key, see history.go
+	if err := modInst.transactExec(`
+		CREATE TABLE IF NOT EXISTS hc_history (
+			profile		string	NOT NULL,
+			network		string	NOT NULL,
+			channel		string	NOT NULL,
+			ts			int64	NOT NULL,
+			data		blob	NOT NULL
+		);`); err != nil {
+		return err
+	}
+	// token is a keyed hash of a word or sender, hid the id() of the hc_history row
+	if err := modInst.transactExec(`
+		CREATE TABLE IF NOT EXISTS hc_search (
+			profile		string	NOT NULL,
+			network		string	NOT NULL,
+			channel		string	NOT NULL,
+			token		string	NOT NULL,
+			hid			int64	NOT NULL
+		);`); err != nil {
+		return err
+	}
+	if err := modInst.transactExec(`
+		CREATE INDEX IF NOT EXISTS hc_search_token ON hc_search (token);`); err != nil {
+		return err
+	}
+	if err := modInst.transactExec(`
+		CREATE TABLE IF NOT EXISTS hc_contact_keys (
+			profile		string	NOT NULL,
+			network		string	NOT NULL,
+			name		string	NOT NULL,
+			pubkey		string	NOT NULL,
+			sigkey		string	NOT NULL,
+			firstseen	int64	NOT NULL,
+			verified	bool	NOT NULL
+		);`); err != nil {
+		return err
+	}
+	if err := modInst.transactExec(`
+		CREATE TABLE IF NOT EXISTS hc_servers (
+			name		string	NOT NULL,
+			pubkey		string	NOT NULL,
+			sigkey		string	NOT NULL,
+			peers		string	NOT NULL,
+			connected	bool	NOT NULL
+		);`); err != nil {
+		return err
+	}
+	return modInst.transactExec(`
+		CREATE TABLE IF NOT EXISTS hc_history_policy (
+			profile		string	NOT NULL,
+			network		string	NOT NULL,
+			channel		string	NOT NULL,
+			maxage		int64	NOT NULL,
+			maxcount	int64	NOT NULL
+		);`)
+}
+
+// chanKeyAD - what a stored channel key is bound to
+func (modInst *Client) chanKeyAD(network, channel string) []byte {
+	return []byte("chankey\x00" + modInst.CurrentProfileName + "\x00" + network + "\x00" + channel)
+}
+
+// addRetiredChannelKey - keep a rotated-out channel key for decrypting, encrypted with the profile's history key
+func (modInst *Client) addRetiredChannelKey(network, channel, privkey string, retired time.Time) error {
+	data, err := modInst.sealData([]byte(privkey), modInst.chanKeyAD(network, channel))
+	if err != nil {
+		return err
+	}
+	return modInst.transactExec("INSERT INTO hc_chan_keys VALUES( $1, $2, $3, $4, $5 );",
+		modInst.CurrentProfileName, network, channel, data, retired.UTC().UnixNano())
+}
+
+// retiredChannelKeys - the current profile's channel keys rotated out since a time, newest first.
+// An empty channel gets those of every channel.
+func (modInst *Client) retiredChannelKeys(network, channel string, since time.Time) ([]retiredKey, error) {
+	c := modInst.DB()
+	defer c.Close()
+	sqlq := "SELECT network, channel, data, retired FROM hc_chan_keys WHERE profile==$1 && retired >= $2 && network==$3 && channel==$4 ORDER BY retired DESC;"
+	params := []interface{}{modInst.CurrentProfileName, since.UTC().UnixNano(), network, channel}
+	if channel == "" {
+		sqlq = "SELECT network, channel, data, retired FROM hc_chan_keys WHERE profile==$1 && retired >= $2 ORDER BY retired DESC;"
+		params = params[:2]
+	}
+	r, err := c.Query(sqlq, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var keys []retiredKey
+	for r.Next() {
+		var k retiredKey
+		var data []byte
+		var retired int64
+		if err := r.Scan(&k.network, &k.channel, &data, &retired); err != nil {
+			return nil, err
+		}
+		clear, err := modInst.openData(data, modInst.chanKeyAD(k.network, k.channel))
+		if err != nil {
+			return nil, err
+		}
+		k.key = string(clear)
+		k.retired = time.Unix(0, retired)
+		keys = append(keys, k)
+	}
+	return keys, r.Err()
+}
+
+// GetRetiredChannelKeys - Get the current profile's rotated-out keys for a channel (b64 keypairs), newest first
+func (modInst *Client) GetRetiredChannelKeys(network, channel string) ([]string, error) {
+	if channel == "" {
+		return nil, errors.New("No channel given")
+	}
+	retired, err := modInst.retiredChannelKeys(network, channel, time.Unix(0, 0))
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, k := range retired {
+		keys = append(keys, k.key)
+	}
+	return keys, nil
+}
+
+// GetChannelConfig - Get the local settings for a channel on a network, nil if none are stored
+func (modInst *Client) GetChannelConfig(network, name string) (*ChannelConfig, error) {
+	c := modInst.DB()
+	defer c.Close()
+	cfg := new(ChannelConfig)
+	cfg.Name = name
+	cfg.Network = network
+	row := c.QueryRow("SELECT password,private FROM hc_chan_config WHERE network==$1 && name==$2;", network, name)
+	if err := row.Scan(&cfg.Password, &cfg.Private); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// channelConfig - the settings for the channel we hold the key for (ratnet keeps one key per
+// channel name, see ClaimChannel). Zero value, with no network, if none are stored.
+func (modInst *Client) channelConfig(name string) (*ChannelConfig, error) {
+	c := modInst.DB()
+	defer c.Close()
+	cfg := new(ChannelConfig)
+	cfg.Name = name
+	row := c.QueryRow("SELECT password,private,network FROM hc_chan_config WHERE name==$1;", name)
+	if err := row.Scan(&cfg.Password, &cfg.Private, &cfg.Network); err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// ClaimChannel - Make a channel name ours on a network, before creating or joining it there.
+// ratnet holds one key per channel name, so it can't be in use on another network.
+func (modInst *Client) ClaimChannel(network, name string) error {
+	cfg, err := modInst.channelConfig(name)
+	if err != nil {
+		return err
+	}
+	if cfg.Network == network {
+		return nil
+	}
+	if key, err := modInst.Node.GetChannelPrivKey(name); cfg.Network != "" && err == nil && key != "" {
+		return errors.New("Already in a channel named " + name + " on " + cfg.Network)
+	}
+	// left over from a join that never went through, or not on any network yet
+	return modInst.transactExec("DELETE FROM hc_chan_config WHERE name==$1 && network!=$2;", name, network)
+}
+
+// forgetChannel - drop a channel's key and settings, once we've left it. Its history is kept.
+func (modInst *Client) forgetChannel(name string) error {
+	if err := modInst.Node.DeleteChannel(name); err != nil {
+		return err
+	}
+	return modInst.transactExec("DELETE FROM hc_chan_config WHERE name==$1;", name)
+}
+
+// SetChannelConfig - Add or update the local settings for a channel
+func (modInst *Client) SetChannelConfig(cfg *ChannelConfig) error {
+	c := modInst.DB()
+	defer c.Close()
+	tx, err := c.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM hc_chan_config WHERE network==$1 && name==$2;", cfg.Network, cfg.Name); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO hc_chan_config VALUES( $1, $2, $3, $4 );",
+		cfg.Name, cfg.Password, cfg.Private, cfg.Network); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
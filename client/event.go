@@ -0,0 +1,102 @@
+package client
+
+import (
+	"time"
+
+	"github.com/awgh/hushcom"
+)
+
+// Event - Something that happened on the client, delivered by Subscribe.
+// Events without a concrete type below are delivered as a JSONResp.
+type Event interface {
+	// Resp : the event as it appears on the JSON event streams
+	Resp() JSONResp
+}
+
+// EventFilter - Selects the events a subscriber wants, nil selects all of them
+type EventFilter func(Event) bool
+
+// EventTypes - Filter for events with the given MsgTypes (e.g. "Channel", "JoinRequest")
+func EventTypes(types ...string) EventFilter {
+	return func(ev Event) bool {
+		msgType := ev.Resp().MsgType
+		for _, t := range types {
+			if t == msgType {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Resp - A JSONResp is its own wire form
+func (r JSONResp) Resp() JSONResp {
+	return r
+}
+
+// ChannelMessage - A message posted to a channel
+type ChannelMessage struct {
+	Network        string
+	Channel        string
+	From           string
+	Text           string
+	Timestamp      time.Time
+	Verified       bool   // signature matched the sender's known key
+	KeyFingerprint string // of the key it was checked against, empty if the sender's key is unknown
+}
+
+// Resp - Wire form of a ChannelMessage
+func (e ChannelMessage) Resp() JSONResp {
+	return JSONResp{MsgType: "Channel", From: e.From, Channel: e.Channel, Network: e.Network, Data: e.Text,
+		Verified: e.Verified, KeyFingerprint: e.KeyFingerprint}
+}
+
+// RegisterResult - The server's answer to a Register
+type RegisterResult struct {
+	Network string
+	From    string
+	Success bool
+}
+
+// Resp - Wire form of a RegisterResult
+func (e RegisterResult) Resp() JSONResp {
+	return JSONResp{MsgType: "RegisterResp", From: e.From, Network: e.Network, Data: hushcom.RegisterRespMsg{Success: e.Success}}
+}
+
+// ChannelList - The server's public channels, in answer to a ListChans
+type ChannelList struct {
+	Network  string
+	From     string
+	Channels []hushcom.Channel
+}
+
+// Resp - Wire form of a ChannelList
+func (e ChannelList) Resp() JSONResp {
+	return JSONResp{MsgType: "ListChansResp", From: e.From, Network: e.Network, Data: hushcom.ListChansRespMsg{Channels: e.Channels}}
+}
+
+// ServerError - A Hushcom server rejected one of our messages
+type ServerError struct {
+	Network       string
+	From          string
+	Code          string // one of the hushcom.ErrCode constants
+	MsgType       string // type of the rejected message
+	CorrelationID string // matches hushcom.Msg.CorrelationID of the rejected message
+	Error         string
+}
+
+// Throttled - The server is dropping our messages for going over its rate limits.
+// It says so once, until one of our messages gets through again.
+func (e ServerError) Throttled() bool {
+	return e.Code == hushcom.ErrCodeThrottled
+}
+
+// Resp - Wire form of a ServerError
+func (e ServerError) Resp() JSONResp {
+	return JSONResp{MsgType: "ErrorResp", From: e.From, Network: e.Network, Data: e}
+}
+
+// Resp - Wire form of a JoinRequest, waiting on approval by a member
+func (e JoinRequest) Resp() JSONResp {
+	return JSONResp{MsgType: "JoinRequest", From: e.From, Channel: e.Channel, Network: e.Network}
+}
@@ -0,0 +1,214 @@
+package client
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultEventBuffer - Events held for each subscriber before the oldest are dropped
+const DefaultEventBuffer = 256
+
+// DefaultEventHistory - Recent events kept for replay to reconnecting subscribers
+const DefaultEventHistory = 1024
+
+// EventRecord - A published event and its ID. IDs increase by one per event, starting above
+// the IDs of earlier runs of the process, see eventHub.init.
+type EventRecord struct {
+	ID   uint64
+	Data []byte // JSON encoded event
+}
+
+// EventSub - One subscriber to the client's event stream (e.g. a WebSocket connection).
+// Each subscriber has its own bounded buffer, so a slow reader never blocks message
+// handling or other subscribers; when its buffer is full the oldest event is dropped.
+type EventSub struct {
+	ch      chan EventRecord
+	dropped uint64
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newEventSub(size int) *EventSub {
+	if size <= 0 {
+		size = DefaultEventBuffer
+	}
+	return &EventSub{ch: make(chan EventRecord, size), done: make(chan struct{})}
+}
+
+// Events - Events in the order they were published
+func (s *EventSub) Events() <-chan EventRecord {
+	return s.ch
+}
+
+// Done - Closed when the subscriber is unsubscribed
+func (s *EventSub) Done() <-chan struct{} {
+	return s.done
+}
+
+// Dropped - Number of events dropped since the last call, because the buffer was full
+func (s *EventSub) Dropped() uint64 {
+	return atomic.SwapUint64(&s.dropped, 0)
+}
+
+func (s *EventSub) push(ev EventRecord) {
+	for {
+		select {
+		case s.ch <- ev:
+			return
+		default:
+		}
+		// full, make room by dropping the oldest event
+		select {
+		case <-s.ch:
+			atomic.AddUint64(&s.dropped, 1)
+		default:
+		}
+	}
+}
+
+type typedSub struct {
+	ch     chan Event
+	filter EventFilter
+}
+
+type eventHub struct {
+	mutex  sync.Mutex
+	subs   map[*EventSub]struct{}
+	typed  map[<-chan Event]*typedSub
+	epoch  uint64 // lastID before this process published anything
+	lastID uint64
+	ring   []EventRecord // last len(ring) events, ring[lastID%len(ring)] is the newest
+}
+
+func (h *eventHub) init(history int) {
+	if history <= 0 {
+		history = DefaultEventHistory
+	}
+	h.subs = make(map[*EventSub]struct{})
+	h.typed = make(map[<-chan Event]*typedSub)
+	h.ring = make([]EventRecord, history)
+	// a Last-Event-ID kept across a restart must not match this run's events. The start
+	// time in seconds, shifted up, stays clear of the last run unless it published over a
+	// million events a second, and within what JavaScript numbers hold exactly.
+	h.epoch = uint64(time.Now().Unix()) << 20
+	h.lastID = h.epoch
+}
+
+// since - Events after ID "after" still in the ring, and how many were lost before them.
+// An ID from another run gets all of this run's events, with at least one lost.
+func (h *eventHub) since(after uint64) ([]EventRecord, uint64) {
+	if after == h.lastID {
+		return nil, 0
+	}
+	var lost uint64
+	if after < h.epoch || after > h.lastID {
+		after = h.epoch
+		lost = 1 // we can't know how many, but the caller has to catch up
+	}
+	first := after + 1
+	if n := uint64(len(h.ring)); h.lastID-after > n {
+		first = h.lastID - n + 1
+		lost += first - after - 1
+	}
+	records := make([]EventRecord, 0, h.lastID-first+1)
+	for id := first; id <= h.lastID; id++ {
+		records = append(records, h.ring[id%uint64(len(h.ring))])
+	}
+	return records, lost
+}
+
+// SubscribeEvents - Start receiving events, with a buffer of size events (DefaultEventBuffer if <= 0)
+func (modInst *Client) SubscribeEvents(size int) *EventSub {
+	sub := newEventSub(size)
+	modInst.events.mutex.Lock()
+	modInst.events.subs[sub] = struct{}{}
+	modInst.events.mutex.Unlock()
+	return sub
+}
+
+// SubscribeEventsAfter - Start receiving events, first returning the events after ID "after"
+// that are still in the replay history. Nothing is missed or repeated between the replayed
+// events and the subscription. lost is the number of events that were too old to replay.
+func (modInst *Client) SubscribeEventsAfter(after uint64, size int) (sub *EventSub, replay []EventRecord, lost uint64) {
+	sub = newEventSub(size)
+	modInst.events.mutex.Lock()
+	replay, lost = modInst.events.since(after)
+	modInst.events.subs[sub] = struct{}{}
+	modInst.events.mutex.Unlock()
+	return sub, replay, lost
+}
+
+// LastEventID - ID of the most recently published event, below any this run will publish if there are none yet
+func (modInst *Client) LastEventID() uint64 {
+	modInst.events.mutex.Lock()
+	defer modInst.events.mutex.Unlock()
+	return modInst.events.lastID
+}
+
+// UnsubscribeEvents - Stop receiving events, closes sub.Done()
+func (modInst *Client) UnsubscribeEvents(sub *EventSub) {
+	modInst.events.mutex.Lock()
+	delete(modInst.events.subs, sub)
+	modInst.events.mutex.Unlock()
+	sub.once.Do(func() { close(sub.done) })
+}
+
+// Subscribe - Receive typed events matching filter (all events if nil). Like the JSON streams,
+// the channel is buffered (DefaultEventBuffer) and the oldest event is dropped when it is full.
+func (modInst *Client) Subscribe(filter EventFilter) <-chan Event {
+	sub := &typedSub{ch: make(chan Event, DefaultEventBuffer), filter: filter}
+	modInst.events.mutex.Lock()
+	modInst.events.typed[sub.ch] = sub
+	modInst.events.mutex.Unlock()
+	return sub.ch
+}
+
+// Unsubscribe - Stop receiving typed events and close the channel returned by Subscribe
+func (modInst *Client) Unsubscribe(ch <-chan Event) {
+	modInst.events.mutex.Lock()
+	defer modInst.events.mutex.Unlock()
+	if sub, ok := modInst.events.typed[ch]; ok {
+		delete(modInst.events.typed, ch)
+		close(sub.ch)
+	}
+}
+
+func (sub *typedSub) push(ev Event) {
+	for {
+		select {
+		case sub.ch <- ev:
+			return
+		default:
+		}
+		select {
+		case <-sub.ch:
+		default:
+		}
+	}
+}
+
+// emit - Deliver an event to typed subscribers and, JSON encoded, to the event streams
+func (modInst *Client) emit(ev Event) error {
+	outb, err := json.Marshal(ev.Resp())
+	if err != nil {
+		log.Println("JSON Marshal failed for event " + ev.Resp().MsgType)
+		return err
+	}
+	modInst.events.mutex.Lock()
+	defer modInst.events.mutex.Unlock()
+	for _, sub := range modInst.events.typed {
+		if sub.filter == nil || sub.filter(ev) {
+			sub.push(ev)
+		}
+	}
+	modInst.events.lastID++
+	rec := EventRecord{ID: modInst.events.lastID, Data: outb}
+	modInst.events.ring[rec.ID%uint64(len(modInst.events.ring))] = rec
+	for sub := range modInst.events.subs {
+		sub.push(rec)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package client
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// emitN - publish n events, the i-th with Channel set to the i-th letter
+func emitN(t *testing.T, c *Client, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := c.emit(JSONResp{MsgType: "Test", Channel: string(rune('a' + i%26))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestEventSubDropsOldest(t *testing.T) {
+	c := New(nil, testDB(t))
+	sub := c.SubscribeEvents(2)
+	defer c.UnsubscribeEvents(sub)
+	emitN(t, c, 5)
+
+	if d := sub.Dropped(); d != 3 {
+		t.Errorf("dropped %d, want 3", d)
+	}
+	if d := sub.Dropped(); d != 0 {
+		t.Errorf("dropped %d on the second call, want it reset", d)
+	}
+	for _, want := range []string{"d", "e"} {
+		var resp JSONResp
+		if err := json.Unmarshal((<-sub.Events()).Data, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Channel != want {
+			t.Errorf("got event %q, want the newest ones kept", resp.Channel)
+		}
+	}
+
+	c.UnsubscribeEvents(sub)
+	select {
+	case <-sub.Done():
+	default:
+		t.Error("Done not closed after unsubscribing")
+	}
+}
+
+func TestSubscribeEventsAfter(t *testing.T) {
+	c := New(nil, testDB(t))
+	c.events.init(4)
+	start := c.LastEventID()
+	emitN(t, c, 3)
+
+	sub, replay, lost := c.SubscribeEventsAfter(start+1, 0)
+	defer c.UnsubscribeEvents(sub)
+	if lost != 0 || len(replay) != 2 || replay[0].ID != start+2 || replay[1].ID != start+3 {
+		t.Fatalf("replay after the first event: %v, lost %d", replay, lost)
+	}
+	// nothing between the replay and the subscription is missed
+	emitN(t, c, 1)
+	if ev := <-sub.Events(); ev.ID != start+4 {
+		t.Errorf("first live event %d, want %d", ev.ID, start+4)
+	}
+
+	// older than the history holds
+	emitN(t, c, 4)
+	_, replay, lost = c.SubscribeEventsAfter(start, 0)
+	if len(replay) != 4 || replay[0].ID != start+5 || lost != 4 {
+		t.Errorf("replay after the start: %d events from %d, lost %d, want 4 from %d, lost 4",
+			len(replay), replay[0].ID, lost, start+5)
+	}
+	// caught up
+	if _, replay, lost = c.SubscribeEventsAfter(c.LastEventID(), 0); len(replay) != 0 || lost != 0 {
+		t.Errorf("replay when caught up: %v, lost %d", replay, lost)
+	}
+	// an ID from another run gets everything there is, flagged as lost
+	if _, replay, lost = c.SubscribeEventsAfter(start-1, 0); len(replay) != 4 || lost == 0 {
+		t.Errorf("replay after an ID from another run: %d events, lost %d", len(replay), lost)
+	}
+}
+
+func TestSubscribeTyped(t *testing.T) {
+	c := New(nil, testDB(t))
+	all := c.Subscribe(nil)
+	chans := c.Subscribe(EventTypes("Channel"))
+	if err := c.emit(ChannelMessage{Channel: "#a", From: "bob", Text: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.emit(JSONResp{MsgType: "NamesResp", Channel: "#a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if ev, ok := (<-chans).(ChannelMessage); !ok || ev.Text != "hi" {
+		t.Errorf("filtered subscriber got %#v, want the ChannelMessage", ev)
+	}
+	select {
+	case ev := <-chans:
+		t.Errorf("filtered subscriber got %#v", ev)
+	default:
+	}
+	if ev := <-all; ev.Resp().MsgType != "Channel" {
+		t.Errorf("first event %q, want Channel", ev.Resp().MsgType)
+	}
+	if ev := <-all; ev.Resp().MsgType != "NamesResp" {
+		t.Errorf("second event %q, want NamesResp", ev.Resp().MsgType)
+	}
+
+	c.Unsubscribe(chans)
+	if _, ok := <-chans; ok {
+		t.Error("channel still open after Unsubscribe")
+	}
+	c.Unsubscribe(chans) // again is a no-op
+}
@@ -0,0 +1,324 @@
+package client
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/awgh/bencrypt/bc"
+)
+
+// DefaultHistoryLimit - Page size for GetHistory when none is given
+const DefaultHistoryLimit = 50
+
+// DefaultHistoryMaxCount - Messages kept per channel unless a HistoryPolicy says otherwise
+const DefaultHistoryMaxCount = 10000
+
+var hcHistoryLabel = []byte{
+	0x52, 0xe1, 0x0b, 0x7c, 0xd4, 0x39, 0x4e, 0x8a,
+	0xb6, 0x13, 0x2f, 0x95, 0xc0, 0x6e, 0x58, 0xa7}
+
+// HistoryEntry - A stored channel message. ID is its position in the history, IDs grow
+// with each stored message, so an entry's ID can be passed as Before to page back from it.
+type HistoryEntry struct {
+	ID        int64
+	Network   string
+	Channel   string
+	From      string
+	Text      string
+	Timestamp time.Time
+}
+
+// historyRecord - the part of a HistoryEntry that is encrypted at rest
+type historyRecord struct {
+	From string
+	Text string
+}
+
+// HistoryPolicy - How much history to keep for a channel. Zero MaxAge keeps messages
+// regardless of age, zero MaxCount keeps DefaultHistoryMaxCount, negative MaxCount keeps none.
+type HistoryPolicy struct {
+	Network  string
+	Channel  string
+	MaxAge   time.Duration
+	MaxCount int
+}
+
+// historyKey - derive the history encryption key from a profile keypair (b64 as stored by ratnet)
+func historyKey(keyPairB64 string) ([]byte, error) {
+	kb, err := base64.StdEncoding.DecodeString(keyPairB64)
+	if err != nil {
+		return nil, err
+	}
+	if len(kb) == 0 {
+		return nil, errors.New("Empty keypair in historyKey")
+	}
+	return bc.Kdf(kb, hcHistoryLabel, nil)
+}
+
+func (modInst *Client) historyAEAD() (cipher.AEAD, error) {
+	if modInst.historyKey == nil {
+		return nil, errors.New("No profile loaded")
+	}
+	block, err := aes.NewCipher(modInst.historyKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// historyAD - what a record is bound to
+func (modInst *Client) historyAD(network, channel string) []byte {
+	return []byte(modInst.CurrentProfileName + "\x00" + network + "\x00" + channel)
+}
+
+// sealData - encrypt data at rest with the profile's history key, bound to ad
+func (modInst *Client) sealData(clear, ad []byte) ([]byte, error) {
+	aead, err := modInst.historyAEAD()
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := bc.GenerateRandomBytes(aead.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, clear, ad), nil
+}
+
+// openData - decrypt data from sealData
+func (modInst *Client) openData(data, ad []byte) ([]byte, error) {
+	aead, err := modInst.historyAEAD()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("Sealed record too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], ad)
+}
+
+// sealHistory - encrypt a record, bound to its profile, network and channel
+func (modInst *Client) sealHistory(network, channel string, rec historyRecord) ([]byte, error) {
+	clear, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	return modInst.sealData(clear, modInst.historyAD(network, channel))
+}
+
+func (modInst *Client) openHistory(network, channel string, data []byte) (historyRecord, error) {
+	var rec historyRecord
+	clear, err := modInst.openData(data, modInst.historyAD(network, channel))
+	if err != nil {
+		return rec, err
+	}
+	err = json.Unmarshal(clear, &rec)
+	return rec, err
+}
+
+// addHistory - store a channel message for the current profile, then apply the channel's retention policy
+func (modInst *Client) addHistory(network, channel, from, text string, ts time.Time) error {
+	if modInst.historyKey == nil {
+		return nil // no profile loaded, nothing to store it under
+	}
+	policy, err := modInst.GetHistoryPolicy(network, channel)
+	if err != nil {
+		return err
+	}
+	if policy.MaxCount < 0 {
+		return nil
+	}
+	data, err := modInst.sealHistory(network, channel, historyRecord{From: from, Text: text})
+	if err != nil {
+		return err
+	}
+	if err := modInst.insertHistory(network, channel, from, text, ts, data); err != nil {
+		return err
+	}
+	return modInst.pruneHistory(policy)
+}
+
+// insertHistory - store an encrypted message and its search index rows in one transaction
+func (modInst *Client) insertHistory(network, channel, from, text string, ts time.Time, data []byte) error {
+	c := modInst.DB()
+	defer c.Close()
+	tx, err := c.Begin()
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec("INSERT INTO hc_history VALUES( $1, $2, $3, $4, $5 );",
+		modInst.CurrentProfileName, network, channel, ts.UTC().UnixNano(), data)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := modInst.indexHistory(tx, id, network, channel, from, text); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// pruneHistory - drop a channel's messages that are older or further back than its policy allows.
+// This runs on every stored message, so nothing is written unless a limit is exceeded.
+func (modInst *Client) pruneHistory(policy *HistoryPolicy) error {
+	pruned, err := modInst.pruneHistoryRows(policy)
+	if err != nil || !pruned {
+		return err
+	}
+	return modInst.pruneSearchIndex(policy.Network, policy.Channel)
+}
+
+// pruneHistoryRows - drop the messages over the policy's limits, true if there were any
+func (modInst *Client) pruneHistoryRows(policy *HistoryPolicy) (bool, error) {
+	c := modInst.DB()
+	defer c.Close()
+	pruned := false
+	var id int64
+	if policy.MaxAge > 0 {
+		cutoff := time.Now().Add(-policy.MaxAge).UTC().UnixNano()
+		row := c.QueryRow("SELECT id() FROM hc_history WHERE profile==$1 && network==$2 && channel==$3 && ts < $4 LIMIT 1;",
+			modInst.CurrentProfileName, policy.Network, policy.Channel, cutoff)
+		if err := row.Scan(&id); err == nil {
+			if err := modInst.transactExec("DELETE FROM hc_history WHERE profile==$1 && network==$2 && channel==$3 && ts < $4;",
+				modInst.CurrentProfileName, policy.Network, policy.Channel, cutoff); err != nil {
+				return pruned, err
+			}
+			pruned = true
+		} else if err != sql.ErrNoRows {
+			return pruned, err
+		}
+	}
+	maxCount := policy.MaxCount
+	if maxCount == 0 {
+		maxCount = DefaultHistoryMaxCount
+	}
+	// the newest message past the limit, if there is one
+	row := c.QueryRow("SELECT id() FROM hc_history WHERE profile==$1 && network==$2 && channel==$3 ORDER BY id() DESC LIMIT 1 OFFSET $4;",
+		modInst.CurrentProfileName, policy.Network, policy.Channel, maxCount)
+	if err := row.Scan(&id); err == nil {
+		if err := modInst.transactExec("DELETE FROM hc_history WHERE profile==$1 && network==$2 && channel==$3 && id() <= $4;",
+			modInst.CurrentProfileName, policy.Network, policy.Channel, id); err != nil {
+			return pruned, err
+		}
+		pruned = true
+	} else if err != sql.ErrNoRows {
+		return pruned, err
+	}
+	return pruned, nil
+}
+
+// GetHistory - Get up to limit of a channel's stored messages from before ID "before"
+// (the newest if before is 0), newest first
+func (modInst *Client) GetHistory(network, channel string, before int64, limit int) ([]HistoryEntry, error) {
+	if limit <= 0 {
+		limit = DefaultHistoryLimit
+	}
+	if modInst.historyKey == nil {
+		return nil, errors.New("No profile loaded")
+	}
+	c := modInst.DB()
+	defer c.Close()
+	sqlq := "SELECT id(), ts, data FROM hc_history WHERE profile==$1 && network==$2 && channel==$3 ORDER BY id() DESC LIMIT $4;"
+	params := []interface{}{modInst.CurrentProfileName, network, channel, limit}
+	if before > 0 {
+		sqlq = "SELECT id(), ts, data FROM hc_history WHERE profile==$1 && network==$2 && channel==$3 && id() < $5 ORDER BY id() DESC LIMIT $4;"
+		params = append(params, before)
+	}
+	r, err := c.Query(sqlq, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var entries []HistoryEntry
+	for r.Next() {
+		var e HistoryEntry
+		var ts int64
+		var data []byte
+		if err := r.Scan(&e.ID, &ts, &data); err != nil {
+			return nil, err
+		}
+		rec, err := modInst.openHistory(network, channel, data)
+		if err != nil {
+			return nil, err
+		}
+		e.Network = network
+		e.Channel = channel
+		e.From = rec.From
+		e.Text = rec.Text
+		e.Timestamp = time.Unix(0, ts)
+		entries = append(entries, e)
+	}
+	return entries, r.Err()
+}
+
+// GetHistoryPolicy - Get the current profile's retention policy for a channel (zero value if none is stored)
+func (modInst *Client) GetHistoryPolicy(network, channel string) (*HistoryPolicy, error) {
+	c := modInst.DB()
+	defer c.Close()
+	policy := new(HistoryPolicy)
+	policy.Network = network
+	policy.Channel = channel
+	var maxAge, maxCount int64
+	row := c.QueryRow("SELECT maxage,maxcount FROM hc_history_policy WHERE profile==$1 && network==$2 && channel==$3;",
+		modInst.CurrentProfileName, network, channel)
+	if err := row.Scan(&maxAge, &maxCount); err == nil {
+		policy.MaxAge = time.Duration(maxAge)
+		policy.MaxCount = int(maxCount)
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+	return policy, nil
+}
+
+func (modInst *Client) saveHistoryPolicy(policy *HistoryPolicy) error {
+	c := modInst.DB()
+	defer c.Close()
+	tx, err := c.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM hc_history_policy WHERE profile==$1 && network==$2 && channel==$3;",
+		modInst.CurrentProfileName, policy.Network, policy.Channel); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO hc_history_policy VALUES( $1, $2, $3, $4, $5 );",
+		modInst.CurrentProfileName, policy.Network, policy.Channel, int64(policy.MaxAge), int64(policy.MaxCount)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetHistoryPolicy - Add or update the current profile's retention policy for a channel,
+// pruning its stored messages to match
+func (modInst *Client) SetHistoryPolicy(policy *HistoryPolicy) error {
+	if modInst.CurrentProfileName == "" {
+		return errors.New("No profile loaded")
+	}
+	if err := modInst.saveHistoryPolicy(policy); err != nil {
+		return err
+	}
+	if policy.MaxCount < 0 {
+		if err := modInst.transactExec("DELETE FROM hc_history WHERE profile==$1 && network==$2 && channel==$3;",
+			modInst.CurrentProfileName, policy.Network, policy.Channel); err != nil {
+			return err
+		}
+		return modInst.transactExec("DELETE FROM hc_search WHERE profile==$1 && network==$2 && channel==$3;",
+			modInst.CurrentProfileName, policy.Network, policy.Channel)
+	}
+	if modInst.historyKey == nil {
+		return nil
+	}
+	return modInst.pruneHistory(policy)
+}
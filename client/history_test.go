@@ -0,0 +1,128 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestHistoryPaging(t *testing.T) {
+	c := profileClient(t, "alice")
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := c.addHistory("net", "#a", "bob", fmt.Sprint("message ", i), now.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.addHistory("net", "#b", "bob", "elsewhere", now); err != nil {
+		t.Fatal(err)
+	}
+
+	var texts []string
+	var before int64
+	for {
+		page, err := c.GetHistory("net", "#a", before, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		if len(page) > 2 {
+			t.Fatalf("page of %d, want at most 2", len(page))
+		}
+		for _, e := range page {
+			if e.Network != "net" || e.Channel != "#a" || e.From != "bob" {
+				t.Errorf("entry %+v", e)
+			}
+			texts = append(texts, e.Text)
+		}
+		before = page[len(page)-1].ID
+	}
+	want := "[message 4 message 3 message 2 message 1 message 0]"
+	if fmt.Sprint(texts) != want {
+		t.Errorf("paged history %v, want %s", texts, want)
+	}
+}
+
+func TestHistorySealed(t *testing.T) {
+	c := profileClient(t, "alice")
+	if err := c.addHistory("net", "#a", "bob", "attack at dawn", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	db := c.DB()
+	var data []byte
+	err := db.QueryRow("SELECT data FROM hc_history;").Scan(&data)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("attack")) || bytes.Contains(data, []byte("bob")) {
+		t.Error("history stored in the clear")
+	}
+	// a record only opens for the profile, network and channel it was stored under
+	if _, err := c.openHistory("net", "#b", data); err == nil {
+		t.Error("record opened as another channel's")
+	}
+	other := New(nil, c.DB)
+	other.CurrentProfileName = "mallory"
+	other.historyKey = c.historyKey
+	if _, err := other.openHistory("net", "#a", data); err == nil {
+		t.Error("record opened under another profile name")
+	}
+	if h, err := other.GetHistory("net", "#a", 0, 0); err != nil || len(h) != 0 {
+		t.Errorf("another profile's history: %v %v", h, err)
+	}
+}
+
+func TestHistoryPolicy(t *testing.T) {
+	c := profileClient(t, "alice")
+	now := time.Now()
+	add := func(text string, ts time.Time) {
+		t.Helper()
+		if err := c.addHistory("net", "#a", "bob", text, ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("old news", now.Add(-2*time.Hour))
+	for i := 0; i < 4; i++ {
+		add(fmt.Sprint("news ", i), now)
+	}
+
+	if err := c.SetHistoryPolicy(&HistoryPolicy{Network: "net", Channel: "#a", MaxAge: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	if h, _ := c.GetHistory("net", "#a", 0, 0); len(h) != 4 {
+		t.Errorf("%d messages kept after pruning by age, want 4", len(h))
+	}
+	if res, _ := c.Search(SearchQuery{Text: "old"}); len(res) != 0 {
+		t.Errorf("pruned message still found: %+v", res)
+	}
+
+	if err := c.SetHistoryPolicy(&HistoryPolicy{Network: "net", Channel: "#a", MaxCount: 2}); err != nil {
+		t.Fatal(err)
+	}
+	add("news 4", now)
+	h, err := c.GetHistory("net", "#a", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h) != 2 || h[0].Text != "news 4" || h[1].Text != "news 3" {
+		t.Errorf("history kept under MaxCount 2: %+v", h)
+	}
+	if res, _ := c.Search(SearchQuery{Text: "news"}); len(res) != 2 {
+		t.Errorf("%d messages found under MaxCount 2, want 2", len(res))
+	}
+	if p, err := c.GetHistoryPolicy("net", "#a"); err != nil || p.MaxCount != 2 || p.MaxAge != 0 {
+		t.Errorf("stored policy %+v %v", p, err)
+	}
+
+	if err := c.SetHistoryPolicy(&HistoryPolicy{Network: "net", Channel: "#a", MaxCount: -1}); err != nil {
+		t.Fatal(err)
+	}
+	add("not kept", now)
+	if h, _ := c.GetHistory("net", "#a", 0, 0); len(h) != 0 {
+		t.Errorf("history kept under a negative MaxCount: %+v", h)
+	}
+}
@@ -0,0 +1,176 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/awgh/hushcom"
+)
+
+// DefaultRequestTimeout - How long a blocking request waits for the server's reply, if ctx has no deadline
+const DefaultRequestTimeout = 30 * time.Second
+
+// RequestError - The server answered a request with an ErrorResp
+type RequestError struct {
+	ServerError
+}
+
+func (e *RequestError) Error() string {
+	return e.MsgType + " rejected by " + e.Network + ": " + e.Code + " " + e.ServerError.Error
+}
+
+// IsThrottled - err is the server dropping a request for going over its rate limits
+func IsThrottled(err error) bool {
+	var rerr *RequestError
+	return errors.As(err, &rerr) && rerr.Throttled()
+}
+
+// pendingRequest - a request waiting on the server's reply
+type pendingRequest struct {
+	network string
+	reply   chan hushcom.Msg
+}
+
+// deliver - hand a server reply to the request waiting on it, if there is one
+func (modInst *Client) deliver(network string, metaData hushcom.Msg) {
+	if metaData.RequestID == "" {
+		return
+	}
+	modInst.requestsMutex.Lock()
+	req, ok := modInst.requests[metaData.RequestID]
+	if ok && req.network == network {
+		delete(modInst.requests, metaData.RequestID)
+		req.reply <- metaData // buffered, and only ever sent once
+	}
+	modInst.requestsMutex.Unlock()
+}
+
+// request - Send a message to a network's Hushcom server and wait for the reply with its RequestID.
+// An ErrorResp reply is returned as a *RequestError.
+func (modInst *Client) request(ctx context.Context, network string, msgType string, hcmsg interface{}) (hushcom.Msg, error) {
+	net, err := modInst.server(network)
+	if err != nil {
+		return hushcom.Msg{}, err
+	}
+	id, err := hushcom.NewRequestID()
+	if err != nil {
+		return hushcom.Msg{}, err
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultRequestTimeout)
+		defer cancel()
+	}
+	req := pendingRequest{network: net.Name, reply: make(chan hushcom.Msg, 1)}
+	modInst.requestsMutex.Lock()
+	modInst.requests[id] = req
+	modInst.requestsMutex.Unlock()
+	defer func() {
+		modInst.requestsMutex.Lock()
+		delete(modInst.requests, id)
+		modInst.requestsMutex.Unlock()
+	}()
+
+	if err := modInst.send(msgType, false, net.Name, modInst.CurrentProfileSigKey, net.PubKey, id, hcmsg); err != nil {
+		return hushcom.Msg{}, err
+	}
+	select {
+	case reply := <-req.reply:
+		if reply.MsgType == "ErrorResp" {
+			var msgObj hushcom.ErrorRespMsg
+			if err := json.Unmarshal(reply.Data, &msgObj); err != nil {
+				return reply, errors.New("Could not unmarshal 'ErrorResp' message")
+			}
+			return reply, &RequestError{ServerError{Network: net.Name, From: reply.From, Code: msgObj.Code,
+				MsgType: msgObj.MsgType, CorrelationID: msgObj.CorrelationID, Error: msgObj.Error}}
+		}
+		return reply, nil
+	case <-ctx.Done():
+		return hushcom.Msg{}, errors.New("No reply to " + msgType + " from " + net.Name + ": " + ctx.Err().Error())
+	}
+}
+
+// requestInto - request, then check the reply type and unmarshal its data into resp
+func (modInst *Client) requestInto(ctx context.Context, network string, msgType string, hcmsg interface{},
+	respType string, resp interface{}) error {
+	reply, err := modInst.request(ctx, network, msgType, hcmsg)
+	if err != nil {
+		return err
+	}
+	if reply.MsgType != respType {
+		return errors.New("Unexpected " + reply.MsgType + " reply to " + msgType)
+	}
+	if err := json.Unmarshal(reply.Data, resp); err != nil {
+		return errors.New("Could not unmarshal '" + respType + "' message")
+	}
+	return nil
+}
+
+// Register - Register the current profile with a network's Hushcom server and wait for the result
+func (modInst *Client) Register(ctx context.Context, network string) error {
+	reg, err := modInst.registerMsg()
+	if err != nil {
+		return err
+	}
+	var resp hushcom.RegisterRespMsg
+	if err := modInst.requestInto(ctx, network, "Register", reg, "RegisterResp", &resp); err != nil {
+		return err
+	}
+	if !resp.Success {
+		return errors.New("Registration failed")
+	}
+	return nil
+}
+
+// ListChannels - Get the public channels on a network's Hushcom server
+func (modInst *Client) ListChannels(ctx context.Context, network string) ([]hushcom.Channel, error) {
+	var resp hushcom.ListChansRespMsg
+	if err := modInst.requestInto(ctx, network, "ListChans", nil, "ListChansResp", &resp); err != nil {
+		return nil, err
+	}
+	return resp.Channels, nil
+}
+
+// Whois - Look up a user's keys on a network's Hushcom server and wait for the answer.
+// Keys that are found get pinned and release waiting messages, as for NewWhoisMsg.
+func (modInst *Client) Whois(ctx context.Context, network string, name string) (hushcom.WhoisRespMsg, error) {
+	var reg hushcom.WhoisMsg
+	reg.Name = name
+	var resp hushcom.WhoisRespMsg
+	err := modInst.requestInto(ctx, network, "Whois", reg, "WhoisResp", &resp)
+	return resp, err
+}
+
+// CreateChannel - Register a new channel with its network's Hushcom server and wait for the result,
+// see NewNewChanMsg
+func (modInst *Client) CreateChannel(ctx context.Context, chanName string, chanPubKey string) error {
+	network, reg, err := modInst.newChanMsg(chanName, chanPubKey)
+	if err != nil {
+		return err
+	}
+	var resp hushcom.NewChanRespMsg
+	return modInst.requestInto(ctx, network, "NewChan", reg, "NewChanResp", &resp)
+}
+
+// ChannelMembers - Get a channel's owner, admins, members and bans from its network's Hushcom server
+func (modInst *Client) ChannelMembers(ctx context.Context, channel string) (hushcom.NamesRespMsg, error) {
+	var reg hushcom.NamesMsg
+	reg.Channel = channel
+	var resp hushcom.NamesRespMsg
+	err := modInst.requestInto(ctx, modInst.channelNetwork(channel), "Names", reg, "NamesResp", &resp)
+	return resp, err
+}
+
+// AdminChannel - Kick, Ban, Unban, Op, Deop or TransferOwner a user on a channel and wait for the result,
+// see NewChanAdminMsg
+func (modInst *Client) AdminChannel(ctx context.Context, action string, channel string, nick string) (hushcom.ChanAdminRespMsg, error) {
+	var resp hushcom.ChanAdminRespMsg
+	reg, err := chanAdminMsg(action, channel, nick)
+	if err != nil {
+		return resp, err
+	}
+	err = modInst.requestInto(ctx, modInst.channelNetwork(channel), action, reg, "ChanAdminResp", &resp)
+	return resp, err
+}
@@ -0,0 +1,168 @@
+package client
+
+import (
+	"bytes"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/hushcom"
+	"github.com/awgh/ratnet/api"
+)
+
+// retiredKeyWindow - how long after a rotation messages sent under the old channel key are still read:
+// as long as a message's timestamp may be off, see hushcom.ReplayCache
+func (modInst *Client) retiredKeyWindow() time.Duration {
+	if modInst.Replay != nil {
+		return modInst.Replay.MaxSkew
+	}
+	return hushcom.DefaultMaxSkew
+}
+
+// retiredKey - a channel key rotated out
+type retiredKey struct {
+	network string
+	channel string
+	key     string // b64 keypair
+	retired time.Time
+}
+
+// retiredKeys - channel keys rotated out lately, see openRetired
+type retiredKeys struct {
+	mutex sync.Mutex
+	keys  map[string][]retiredKey // by channel, newest first
+	seen  map[string]time.Time    // nonces of messages opened with a retired key, when opened
+}
+
+func (r *retiredKeys) reset(keys []retiredKey) {
+	r.mutex.Lock()
+	r.keys = make(map[string][]retiredKey)
+	r.seen = make(map[string]time.Time)
+	for _, k := range keys {
+		r.keys[k.channel] = append(r.keys[k.channel], k)
+	}
+	r.mutex.Unlock()
+}
+
+func (r *retiredKeys) add(k retiredKey) {
+	r.mutex.Lock()
+	r.keys[k.channel] = append([]retiredKey{k}, r.keys[k.channel]...)
+	r.mutex.Unlock()
+}
+
+// prune - forget keys and nonces older than window, must hold the mutex
+func (r *retiredKeys) prune(now time.Time, window time.Duration) {
+	for channel, keys := range r.keys {
+		n := 0
+		for n < len(keys) && now.Sub(keys[n].retired) <= window {
+			n++
+		}
+		if n == 0 {
+			delete(r.keys, channel)
+		} else {
+			r.keys[channel] = keys[:n]
+		}
+	}
+	for nonce, t := range r.seen {
+		if now.Sub(t) > window {
+			delete(r.seen, nonce)
+		}
+	}
+}
+
+// retireChannelKey - keep a rotated-out channel key, to read messages still sent under it
+func (modInst *Client) retireChannelKey(network, channel, key string) error {
+	k := retiredKey{network: network, channel: channel, key: key, retired: time.Now()}
+	if err := modInst.addRetiredChannelKey(network, channel, key, k.retired); err != nil {
+		return err
+	}
+	modInst.retired.add(k)
+	return nil
+}
+
+// loadRetiredKeys - load the current profile's recently retired channel keys
+func (modInst *Client) loadRetiredKeys() error {
+	keys, err := modInst.retiredChannelKeys("", "", time.Now().Add(-modInst.retiredKeyWindow()))
+	if err != nil {
+		return err
+	}
+	modInst.retired.reset(keys)
+	return nil
+}
+
+// openRetired - decrypt a channel message the channel's current key can't, with a key
+// retired within retiredKeyWindow. Each message is opened once.
+func (modInst *Client) openRetired(channel string, ciphertext []byte) ([]byte, bool) {
+	window := modInst.retiredKeyWindow()
+	r := &modInst.retired
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.prune(time.Now(), window)
+	if len(r.keys[channel]) == 0 || len(ciphertext) < 96 { // shorter isn't an ecc message
+		return nil, false
+	}
+	nonce := string(ciphertext[:32])
+	if _, ok := r.seen[nonce]; ok {
+		return nil, false
+	}
+	// the node already handed on anything its current key opens
+	if priv, err := modInst.Node.GetChannelPrivKey(channel); err == nil && priv != "" {
+		current := new(ecc.KeyPair)
+		if current.FromB64(priv) == nil {
+			if ok, _, _ := current.DecryptMessage(ciphertext); ok {
+				return nil, false
+			}
+		}
+	}
+	for _, k := range r.keys[channel] {
+		key := new(ecc.KeyPair)
+		if err := key.FromB64(k.key); err != nil {
+			log.Println("Bad retired key for " + channel + ": " + err.Error())
+			continue
+		}
+		if ok, clear, err := key.DecryptMessage(ciphertext); ok && err == nil {
+			r.seen[nonce] = time.Now()
+			return clear, true
+		}
+	}
+	return nil, false
+}
+
+// Router - a ratnet router that also hands on channel messages sent under a channel key
+// retired within retiredKeyWindow, from members who haven't switched to the new one yet
+type Router struct {
+	api.Router
+	client *Client
+}
+
+// NewRouter - wrap a node's router, see Router
+func NewRouter(router api.Router, client *Client) *Router {
+	return &Router{Router: router, client: client}
+}
+
+// Route - route a message with the wrapped router, then try the retired keys on it
+func (r *Router) Route(node api.Node, message []byte) error {
+	if err := r.Router.Route(node, message); err != nil {
+		return err
+	}
+	// flags, name length and name, as ratnet puts them; chunked and streamed messages aren't Hushcom's
+	if len(message) < 3 || message[0]&api.ChannelFlag == 0 ||
+		message[0]&(api.ChunkedFlag|api.StreamHeaderFlag) != 0 {
+		return nil
+	}
+	n := 3 + (int(message[1])<<8 | int(message[2]))
+	if len(message) < n {
+		return nil
+	}
+	channel := string(message[3:n])
+	clear, ok := r.client.openRetired(channel, message[n:])
+	if !ok {
+		return nil
+	}
+	select {
+	case node.Out() <- api.Msg{Name: channel, IsChan: true, Content: bytes.NewBuffer(clear)}:
+	default:
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/awgh/bencrypt/bc"
+)
+
+// DefaultSearchLimit - Results returned by Search when no limit is given
+const DefaultSearchLimit = 50
+
+// minTokenLen - shorter words are not indexed
+const minTokenLen = 2
+
+var hcSearchLabel = []byte{
+	0xa3, 0x07, 0x6d, 0xf1, 0x2c, 0x98, 0x45, 0xbe,
+	0x1f, 0x83, 0xe4, 0x5a, 0x70, 0xc9, 0x36, 0x0d}
+
+// SearchQuery - What to look for in the local history. Empty fields match everything,
+// Text matches messages containing all of its words.
+type SearchQuery struct {
+	Text    string
+	Network string
+	Channel string
+	From    string
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+// SearchResult - A matching message. Before is its position in the channel history:
+// GetHistory(Network, Channel, Before, n) pages back from and including this message.
+type SearchResult struct {
+	HistoryEntry
+	Before int64
+}
+
+// Tokenize - Split text into lower case words for indexing and searching
+func Tokenize(text string) []string {
+	seen := make(map[string]bool)
+	var tokens []string
+	for _, f := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		if len([]rune(f)) >= minTokenLen && !seen[f] {
+			seen[f] = true
+			tokens = append(tokens, f)
+		}
+	}
+	return tokens
+}
+
+// searchToken - the index stores keyed hashes of words, never the words themselves
+func (modInst *Client) searchToken(kind, word string) (string, error) {
+	if modInst.historyKey == nil {
+		return "", errors.New("No profile loaded")
+	}
+	key, err := bc.Kdf(modInst.historyKey, hcSearchLabel, nil)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(kind + "\x00" + word))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)[:16]), nil
+}
+
+// indexHistory - add the search index rows for a stored message to tx
+func (modInst *Client) indexHistory(tx *sql.Tx, id int64, network, channel, from, text string) error {
+	words := []string{"from", from}
+	for _, t := range Tokenize(text) {
+		words = append(words, "text", t)
+	}
+	for i := 0; i < len(words); i += 2 {
+		tok, err := modInst.searchToken(words[i], words[i+1])
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO hc_search VALUES( $1, $2, $3, $4, $5 );",
+			modInst.CurrentProfileName, network, channel, tok, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneSearchIndex - drop index rows whose message was pruned from the history
+func (modInst *Client) pruneSearchIndex(network, channel string) error {
+	return modInst.transactExec(`DELETE FROM hc_search WHERE profile==$1 && network==$2 && channel==$3 &&
+		!(hid IN (SELECT id() FROM hc_history WHERE profile==$1 && network==$2 && channel==$3));`,
+		modInst.CurrentProfileName, network, channel)
+}
+
+// searchIDs - history IDs with every given token, nil if no tokens were given
+func (modInst *Client) searchIDs(c *sql.DB, network, channel string, tokens []string) (map[int64]bool, error) {
+	var ids map[int64]bool
+	for _, tok := range tokens {
+		sqlq := "SELECT hid FROM hc_search WHERE profile==$1 && token==$2"
+		params := []interface{}{modInst.CurrentProfileName, tok}
+		if network != "" {
+			params = append(params, network)
+			sqlq += " && network==$" + strconv.Itoa(len(params))
+		}
+		if channel != "" {
+			params = append(params, channel)
+			sqlq += " && channel==$" + strconv.Itoa(len(params))
+		}
+		sqlq += ";"
+		r, err := c.Query(sqlq, params...)
+		if err != nil {
+			return nil, err
+		}
+		found := make(map[int64]bool)
+		for r.Next() {
+			var id int64
+			if err := r.Scan(&id); err != nil {
+				r.Close()
+				return nil, err
+			}
+			if ids == nil || ids[id] {
+				found[id] = true
+			}
+		}
+		err = r.Err()
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+		ids = found
+		if len(ids) == 0 {
+			break
+		}
+	}
+	return ids, nil
+}
+
+// Search - Find messages in the current profile's local history, newest first
+func (modInst *Client) Search(q SearchQuery) ([]SearchResult, error) {
+	if q.Limit <= 0 {
+		q.Limit = DefaultSearchLimit
+	}
+	var tokens []string
+	if q.From != "" {
+		tok, err := modInst.searchToken("from", q.From)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, tok)
+	}
+	words := Tokenize(q.Text)
+	if strings.TrimSpace(q.Text) != "" && len(words) == 0 {
+		return nil, nil // only words too short to be indexed, nothing can match
+	}
+	for _, w := range words {
+		tok, err := modInst.searchToken("text", w)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, tok)
+	}
+	if modInst.historyKey == nil {
+		return nil, errors.New("No profile loaded")
+	}
+
+	c := modInst.DB()
+	defer c.Close()
+	ids, err := modInst.searchIDs(c, q.Network, q.Channel, tokens)
+	if err != nil {
+		return nil, err
+	}
+	if ids != nil && len(ids) == 0 {
+		return nil, nil
+	}
+
+	sqlq := "SELECT id(), network, channel, ts, data FROM hc_history WHERE profile==$1 && ts >= $2 && ts <= $3"
+	params := []interface{}{modInst.CurrentProfileName, int64(0), int64(1<<63 - 1)}
+	if !q.Since.IsZero() {
+		params[1] = q.Since.UTC().UnixNano()
+	}
+	if !q.Until.IsZero() {
+		params[2] = q.Until.UTC().UnixNano()
+	}
+	if q.Network != "" {
+		params = append(params, q.Network)
+		sqlq += " && network==$" + strconv.Itoa(len(params))
+	}
+	if q.Channel != "" {
+		params = append(params, q.Channel)
+		sqlq += " && channel==$" + strconv.Itoa(len(params))
+	}
+	r, err := c.Query(sqlq+" ORDER BY id() DESC;", params...)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var results []SearchResult
+	for r.Next() && len(results) < q.Limit {
+		var res SearchResult
+		var ts int64
+		var data []byte
+		if err := r.Scan(&res.ID, &res.Network, &res.Channel, &ts, &data); err != nil {
+			return nil, err
+		}
+		if ids != nil && !ids[res.ID] {
+			continue
+		}
+		rec, err := modInst.openHistory(res.Network, res.Channel, data)
+		if err != nil {
+			return nil, err
+		}
+		res.From = rec.From
+		res.Text = rec.Text
+		res.Timestamp = time.Unix(0, ts)
+		res.Before = res.ID + 1
+		results = append(results, res)
+	}
+	return results, r.Err()
+}
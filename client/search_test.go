@@ -0,0 +1,80 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTokenize(t *testing.T) {
+	got := Tokenize("Hello, hello WORLD! a 42 über-cool")
+	want := []string{"hello", "world", "42", "über", "cool"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Tokenize: got %q, want %q", got, want)
+	}
+}
+
+func TestSearchTokensAreKeyed(t *testing.T) {
+	alice := profileClient(t, "alice")
+	bob := profileClient(t, "bob")
+	a, err := alice.searchToken("text", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := bob.searchToken("text", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, err := alice.searchToken("from", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b || a == from || a == "hello" {
+		t.Errorf("tokens for one word: %q, %q and %q, want them to differ by profile and kind", a, b, from)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	c := profileClient(t, "alice")
+	now := time.Now()
+	for i, m := range []struct{ channel, from, text string }{
+		{"#a", "bob", "the quick brown fox"},
+		{"#a", "carol", "a quick reply"},
+		{"#b", "bob", "nothing to see"},
+	} {
+		if err := c.addHistory("net", m.channel, m.from, m.text, now.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	texts := func(q SearchQuery) []string {
+		t.Helper()
+		res, err := c.Search(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var texts []string
+		for _, r := range res {
+			texts = append(texts, r.Text)
+		}
+		return texts
+	}
+	for _, tc := range []struct {
+		q    SearchQuery
+		want []string
+	}{
+		{SearchQuery{Text: "QUICK"}, []string{"a quick reply", "the quick brown fox"}},
+		{SearchQuery{Text: "quick fox"}, []string{"the quick brown fox"}},
+		{SearchQuery{From: "bob"}, []string{"nothing to see", "the quick brown fox"}},
+		{SearchQuery{From: "bob", Channel: "#b"}, []string{"nothing to see"}},
+		{SearchQuery{Text: "quick", Limit: 1}, []string{"a quick reply"}},
+		{SearchQuery{Text: "missing"}, nil},
+		// every word is too short to be indexed
+		{SearchQuery{Text: "a"}, nil},
+		{SearchQuery{}, []string{"nothing to see", "a quick reply", "the quick brown fox"}},
+	} {
+		if got := texts(tc.q); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Search(%+v): got %q, want %q", tc.q, got, tc.want)
+		}
+	}
+}
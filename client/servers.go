@@ -0,0 +1,309 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/awgh/bencrypt/bc"
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/hushcom"
+)
+
+// Demo server identity, used by hushcom when no server is configured. There is no default
+// signing key: it's derived from the server's private content key, see ServerConfig.SigKey.
+const (
+	// DefaultServerName - ratnet contact name for the demo Hushcom server
+	DefaultServerName = "HushComServer"
+	// DefaultServerPubKey - b64 content pubkey of the demo Hushcom server
+	DefaultServerPubKey = "EuUE0KI4cySH/BkLSHlr7iBAaYikdYAC6M0GhxMk3Ew="
+	// DefaultServerPeer - ratnet peer URI the demo Hushcom server is reached through
+	DefaultServerPeer = "127.0.0.1:20001"
+)
+
+// ServerConfig - A Hushcom server this client can talk to. The server's Name is
+// also the name of its network in events and REST calls.
+type ServerConfig struct {
+	Name      string   // ratnet contact name for the server
+	PubKey    string   // b64 content pubkey, messages to the server are encrypted to it
+	SigKey    string   // b64 signing pubkey, checks the server's replies. hushcomd logs it at startup as "Public Signing Key"
+	Peers     []string // ratnet peer URIs the server is reached through
+	Connected bool     // talked to on startup, see ConnectServer
+}
+
+// Network - Status of a connected Hushcom server
+type Network struct {
+	Name       string
+	Registered bool              // the server accepted our Register
+	Channels   []hushcom.Channel // public channels, from the last ListChansResp
+}
+
+// network - a connected server's keys and state
+type network struct {
+	Network
+	PubKey bc.PubKey
+	SigKey ed25519.PublicKey
+}
+
+type serverState struct {
+	mutex sync.Mutex
+	nets  map[string]*network
+}
+
+func parseServerConfig(cfg *ServerConfig) (*network, error) {
+	if cfg.Name == "" {
+		return nil, errors.New("Server name is required")
+	}
+	if cfg.SigKey == "" {
+		return nil, errors.New("Server signing key is required, it's the \"Public Signing Key\" hushcomd logs at startup")
+	}
+	pk := new(ecc.PubKey)
+	if err := pk.FromB64(cfg.PubKey); err != nil {
+		return nil, err
+	}
+	sk, err := hushcom.SigKeyFromB64(cfg.SigKey)
+	if err != nil {
+		return nil, err
+	}
+	net := &network{PubKey: pk, SigKey: sk}
+	net.Name = cfg.Name
+	return net, nil
+}
+
+// server - a connected server by name. An empty name is allowed while only one server is connected.
+func (modInst *Client) server(name string) (*network, error) {
+	modInst.servers.mutex.Lock()
+	defer modInst.servers.mutex.Unlock()
+	if name == "" {
+		if len(modInst.servers.nets) == 1 {
+			for _, net := range modInst.servers.nets {
+				return net, nil
+			}
+		}
+		if len(modInst.servers.nets) == 0 {
+			return nil, errors.New("No Hushcom server configured")
+		}
+		return nil, errors.New("Several Hushcom servers are connected, a network is required")
+	}
+	net, ok := modInst.servers.nets[name]
+	if !ok {
+		return nil, errors.New("Not connected to Hushcom server: " + name)
+	}
+	return net, nil
+}
+
+// ResolveNetwork - The name of a connected network, see server for the empty name
+func (modInst *Client) ResolveNetwork(name string) (string, error) {
+	net, err := modInst.server(name)
+	if err != nil {
+		return "", err
+	}
+	return net.Name, nil
+}
+
+// serverFor - the connected server that signed a message, nil if none did
+func (modInst *Client) serverFor(metaData hushcom.Msg) *network {
+	modInst.servers.mutex.Lock()
+	defer modInst.servers.mutex.Unlock()
+	for _, net := range modInst.servers.nets {
+		if hushcom.VerifyMsg(net.SigKey, metaData) {
+			return net
+		}
+	}
+	return nil
+}
+
+// updateServer - change a connected server's state under the lock
+func (modInst *Client) updateServer(net *network, update func(*Network)) {
+	modInst.servers.mutex.Lock()
+	update(&net.Network)
+	modInst.servers.mutex.Unlock()
+}
+
+// toServer - Send a message to a connected Hushcom server, see server for the name
+func (modInst *Client) toServer(name string, msgType string, hcmsg interface{}) error {
+	net, err := modInst.server(name)
+	if err != nil {
+		return err
+	}
+	return modInst.HCSend(msgType, false, net.Name, modInst.CurrentProfileSigKey, net.PubKey, hcmsg)
+}
+
+// toChannelServer - Send a message to the Hushcom server a channel is on
+func (modInst *Client) toChannelServer(channel string, msgType string, hcmsg interface{}) error {
+	return modInst.toServer(modInst.channelNetwork(channel), msgType, hcmsg)
+}
+
+// channelNetwork - the network a channel is on, empty if unknown
+func (modInst *Client) channelNetwork(channel string) string {
+	cfg, err := modInst.channelConfig(channel)
+	if err != nil {
+		return ""
+	}
+	return cfg.Network
+}
+
+// GetNetworks - Status of each connected Hushcom server, by name
+func (modInst *Client) GetNetworks() []Network {
+	modInst.servers.mutex.Lock()
+	defer modInst.servers.mutex.Unlock()
+	var nets []Network
+	for _, net := range modInst.servers.nets {
+		nets = append(nets, net.Network)
+	}
+	sort.Slice(nets, func(i, j int) bool { return nets[i].Name < nets[j].Name })
+	return nets
+}
+
+// connect - start talking to a server, and tell ratnet how to reach it
+func (modInst *Client) connect(cfg *ServerConfig) error {
+	net, err := parseServerConfig(cfg)
+	if err != nil {
+		return err
+	}
+	if err := modInst.Node.AddContact(cfg.Name, cfg.PubKey); err != nil {
+		return err
+	}
+	for i, uri := range cfg.Peers {
+		if err := modInst.Node.AddPeer(fmt.Sprintf("%s-%d", cfg.Name, i), true, uri); err != nil {
+			return err
+		}
+	}
+	modInst.servers.mutex.Lock()
+	if old, ok := modInst.servers.nets[cfg.Name]; ok {
+		net.Network = old.Network // same server, keep its state
+	}
+	modInst.servers.nets[cfg.Name] = net
+	modInst.servers.mutex.Unlock()
+	return nil
+}
+
+// loadServers - connect to the stored servers marked Connected
+func (modInst *Client) loadServers() error {
+	servers, err := modInst.GetServers()
+	if err != nil {
+		return err
+	}
+	for _, cfg := range servers {
+		if cfg.Connected {
+			if err := modInst.connect(cfg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (modInst *Client) saveServer(cfg *ServerConfig) error {
+	c := modInst.DB()
+	defer c.Close()
+	tx, err := c.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM hc_servers WHERE name==$1;", cfg.Name); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO hc_servers VALUES( $1, $2, $3, $4, $5 );",
+		cfg.Name, cfg.PubKey, cfg.SigKey, strings.Join(cfg.Peers, ","), cfg.Connected); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetServer - Add or update a Hushcom server and connect to it
+func (modInst *Client) SetServer(cfg *ServerConfig) error {
+	if _, err := parseServerConfig(cfg); err != nil {
+		return err
+	}
+	cfg.Connected = true
+	if err := modInst.saveServer(cfg); err != nil {
+		return err
+	}
+	return modInst.connect(cfg)
+}
+
+// GetServer - Get a stored Hushcom server, nil if there is none by that name
+func (modInst *Client) GetServer(name string) (*ServerConfig, error) {
+	servers, err := modInst.GetServers()
+	if err != nil {
+		return nil, err
+	}
+	for _, cfg := range servers {
+		if cfg.Name == name {
+			return cfg, nil
+		}
+	}
+	return nil, nil
+}
+
+// ConnectServer - Connect to a stored Hushcom server, now and on startup
+func (modInst *Client) ConnectServer(name string) error {
+	cfg, err := modInst.GetServer(name)
+	if err != nil {
+		return err
+	}
+	if cfg == nil {
+		return errors.New("Unknown Hushcom server: " + name)
+	}
+	return modInst.SetServer(cfg)
+}
+
+// DisconnectServer - Stop talking to a Hushcom server, keeping its config
+func (modInst *Client) DisconnectServer(name string) error {
+	cfg, err := modInst.GetServer(name)
+	if err != nil {
+		return err
+	}
+	if cfg == nil {
+		return errors.New("Unknown Hushcom server: " + name)
+	}
+	cfg.Connected = false
+	if err := modInst.saveServer(cfg); err != nil {
+		return err
+	}
+	modInst.servers.mutex.Lock()
+	delete(modInst.servers.nets, name)
+	modInst.servers.mutex.Unlock()
+	return nil
+}
+
+// GetServers - Get all stored Hushcom servers
+func (modInst *Client) GetServers() ([]*ServerConfig, error) {
+	c := modInst.DB()
+	defer c.Close()
+	r, err := c.Query("SELECT name,pubkey,sigkey,peers,connected FROM hc_servers ORDER BY name;")
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var servers []*ServerConfig
+	for r.Next() {
+		cfg := new(ServerConfig)
+		var peers string
+		if err := r.Scan(&cfg.Name, &cfg.PubKey, &cfg.SigKey, &peers, &cfg.Connected); err != nil {
+			return nil, err
+		}
+		if peers != "" {
+			cfg.Peers = strings.Split(peers, ",")
+		}
+		servers = append(servers, cfg)
+	}
+	return servers, r.Err()
+}
+
+// DeleteServer - Disconnect from and forget a stored Hushcom server
+func (modInst *Client) DeleteServer(name string) error {
+	if err := modInst.transactExec("DELETE FROM hc_servers WHERE name==$1;", name); err != nil {
+		return err
+	}
+	modInst.servers.mutex.Lock()
+	delete(modInst.servers.nets, name)
+	modInst.servers.mutex.Unlock()
+	return nil
+}
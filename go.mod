@@ -6,4 +6,7 @@ require (
 	github.com/awgh/bencrypt v0.0.0-20190918184257-b65cb460b2c8
 	github.com/awgh/ratnet v1.1.0
 	github.com/coocood/jas v0.0.0-20150406024540-e8ccaf9a2db6
+	github.com/gorilla/websocket v1.4.2
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
+	modernc.org/ql v1.3.1
 )
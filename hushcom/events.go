@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/awgh/hushcom/client"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	eventsWriteWait  = 10 * time.Second
+	eventsPingPeriod = 30 * time.Second
+	eventsPongWait   = 2 * eventsPingPeriod
+)
+
+// Events - WebSocket endpoint pushing client events as JSON text frames
+type Events struct {
+	hc       *client.Client
+	upgrader websocket.Upgrader
+}
+
+func newEvents(hc *client.Client) *Events {
+	e := new(Events)
+	e.hc = hc
+	return e
+}
+
+// ServeHTTP - Upgrade to a WebSocket and stream events until either side hangs up
+func (e *Events) ServeHTTP(w http.ResponseWriter, r *http.Request) { // `GET /v1/events`
+	conn, err := e.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("events upgrade: " + err.Error())
+		return
+	}
+	defer conn.Close()
+
+	sub := e.hc.SubscribeEvents(client.DefaultEventBuffer)
+	defer e.hc.UnsubscribeEvents(sub)
+
+	// nothing is expected from the browser, but reading handles pongs and notices a close
+	conn.SetReadDeadline(time.Now().Add(eventsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(eventsPongWait))
+	})
+	go func() {
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				e.hc.UnsubscribeEvents(sub)
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(eventsPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sub.Done():
+			return
+		case ev := <-sub.Events():
+			// tell the browser it fell behind, so it can refresh state
+			if n := sub.Dropped(); n > 0 {
+				dropped, err := json.Marshal(client.JSONResp{MsgType: "EventsDropped", Data: n})
+				if err == nil {
+					if err := e.write(conn, dropped); err != nil {
+						return
+					}
+				}
+			}
+			if err := e.write(conn, ev.Data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(eventsWriteWait)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (e *Events) write(conn *websocket.Conn, ev []byte) error {
+	conn.SetWriteDeadline(time.Now().Add(eventsWriteWait))
+	return conn.WriteMessage(websocket.TextMessage, ev)
+}
+
+// EventsSSE - Server-Sent Events endpoint, for clients that can't use WebSockets
+type EventsSSE struct {
+	hc *client.Client
+}
+
+func newEventsSSE(hc *client.Client) *EventsSSE {
+	e := new(EventsSSE)
+	e.hc = hc
+	return e
+}
+
+// ServeHTTP - Stream events as SSE, replaying anything after Last-Event-ID first
+func (e *EventsSSE) ServeHTTP(w http.ResponseWriter, r *http.Request) { // `GET /v1/events/sse`
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	// EventSource sends the header on reconnect, curl scripts can use either
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("LastEventID")
+	}
+	var sub *client.EventSub
+	var replay []client.EventRecord
+	var lost uint64
+	if lastID != "" {
+		after, err := strconv.ParseUint(lastID, 10, 64)
+		if err != nil {
+			http.Error(w, "bad Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		sub, replay, lost = e.hc.SubscribeEventsAfter(after, client.DefaultEventBuffer)
+	} else {
+		sub = e.hc.SubscribeEvents(client.DefaultEventBuffer)
+	}
+	defer e.hc.UnsubscribeEvents(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	if err := e.dropped(w, lost); err != nil {
+		return
+	}
+	for _, ev := range replay {
+		if err := e.write(w, ev); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(eventsPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-sub.Done():
+			return
+		case ev := <-sub.Events():
+			if err := e.dropped(w, sub.Dropped()); err != nil {
+				return
+			}
+			if err := e.write(w, ev); err != nil {
+				return
+			}
+		case <-ticker.C:
+			// comment line, keeps proxies from timing out an idle stream
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func (e *EventsSSE) write(w io.Writer, ev client.EventRecord) error {
+	_, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", ev.ID, ev.Data)
+	return err
+}
+
+// dropped - tell the client it missed n events, without an id so Last-Event-ID is unchanged
+func (e *EventsSSE) dropped(w io.Writer, n uint64) error {
+	if n == 0 {
+		return nil
+	}
+	b, err := json.Marshal(client.JSONResp{MsgType: "EventsDropped", Data: n})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "data: %s\n\n", b)
+	return err
+}
@@ -1,16 +1,19 @@
 package main
 
 import (
+	"database/sql"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"runtime"
+	"strings"
+	"time"
 
 	"github.com/awgh/bencrypt/bc"
 	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/hushcom"
 	"github.com/awgh/hushcom/client"
 	"github.com/awgh/ratnet/api"
 	"github.com/awgh/ratnet/nodes/qldb"
@@ -28,7 +31,8 @@ func handleCORS(r *http.Request, responseHeader http.Header) bool {
 	return r.Method != "OPTIONS"
 }
 
-func serve(transportAdmin api.Transport, node api.Node, listenRest, certfile, keyfile string) {
+func serve(transportAdmin api.Transport, node api.Node, db func() *sql.DB, maxSkew time.Duration,
+	server *client.ServerConfig, listenRest, certfile, keyfile string) {
 	node.FlushOutbox(0)
 	node.SetPolicy(
 		poll.New(transportAdmin, node, 500, 0))
@@ -41,24 +45,23 @@ func serve(transportAdmin api.Transport, node api.Node, listenRest, certfile, ke
 	}
 	log.Println("Public Routing Key: " + pubsrv.ToB64())
 
-	if err := node.AddContact(client.HUSHCOM, client.HUSHCOMPKA); err != nil {
-		log.Fatal(err.Error())
-	}
-
-	var peer api.Peer
-	debug := true // todo: make this a CLI param
-	if debug {
-		peer = api.Peer{Name: "localhost", URI: "127.0.0.1:20001", Enabled: true}
-	} else if runtime.GOOS == "android" {
-		peer = api.Peer{Name: "awgh.wtf.im", URI: "104.233.91.188:20001", Enabled: true}
-	} else {
-		peer = api.Peer{Name: "awgh.wtf.im", URI: "awgh.wtf.im:20001", Enabled: true}
+	hc := client.New(node, db)
+	hc.Replay.MaxSkew = maxSkew
+	// read messages from members still on a channel's old key after a rotation
+	node.SetRouter(client.NewRouter(node.Router(), hc))
+	// add the server from the command line if one was given, otherwise use the stored ones
+	if server != nil || len(hc.GetNetworks()) == 0 {
+		if server == nil || server.SigKey == "" {
+			log.Fatal("No Hushcom server configured: -serversigkey is required, " +
+				"use the \"Public Signing Key\" the server's hushcomd logs at startup")
+		}
+		if err := hc.SetServer(server); err != nil {
+			log.Fatal(err.Error())
+		}
 	}
-	if err := node.AddPeer(peer.Name, peer.Enabled, peer.URI); err != nil {
-		log.Fatal(err.Error())
+	for _, net := range hc.GetNetworks() {
+		log.Println("Hushcom Server: " + net.Name)
 	}
-
-	hc := client.New(node)
 	go func() {
 		for {
 			msg := <-node.Out()
@@ -69,7 +72,7 @@ func serve(transportAdmin api.Transport, node api.Node, listenRest, certfile, ke
 	}()
 
 	// start REST api second, since it does not trigger cert generation
-	router := jas.NewRouter(newProfile(hc), newServer(hc), newChannel(hc), newRemote(hc), newPoll(hc))
+	router := jas.NewRouter(newProfile(hc), newServer(hc), newChannel(hc), newUser(hc), newRemote(hc), newSearch(hc), newContact(hc))
 	router.BasePath = "/v1/"
 	router.HandleCORS = handleCORS
 
@@ -82,6 +85,8 @@ func serve(transportAdmin api.Transport, node api.Node, listenRest, certfile, ke
 	fs := http.FileServer(http.Dir("js"))
 	mux.Handle("/js/", http.StripPrefix("/js/", fs))
 
+	mux.Handle(router.BasePath+"events", newEvents(hc))
+	mux.Handle(router.BasePath+"events/sse", newEventsSSE(hc))
 	mux.Handle(router.BasePath, router)
 	fmt.Println(router.HandledPaths(true))
 
@@ -93,15 +98,36 @@ func serve(transportAdmin api.Transport, node api.Node, listenRest, certfile, ke
 func main() {
 	var dbFile string
 	var restPort int
+	var maxSkew time.Duration
 
 	flag.StringVar(&dbFile, "dbfile", "ratnet.ql", "QL Database File")
 	flag.IntVar(&restPort, "p", 20011, "HTTPS REST Port (localhost)")
+	flag.DurationVar(&maxSkew, "skew", hushcom.DefaultMaxSkew, "Max Message Clock Skew (0 disables)")
+
+	server := new(client.ServerConfig)
+	var peers string
+	flag.StringVar(&server.Name, "server", client.DefaultServerName, "Hushcom Server Name")
+	flag.StringVar(&server.PubKey, "serverkey", client.DefaultServerPubKey, "Hushcom Server Public Key (b64)")
+	flag.StringVar(&server.SigKey, "serversigkey", "", "Hushcom Server Signing Key (b64, the \"Public Signing Key\" hushcomd logs at startup)")
+	flag.StringVar(&peers, "peers", client.DefaultServerPeer, "Hushcom Server Peer URIs (comma separated)")
 
 	flag.Parse()
+	server.Peers = strings.Split(peers, ",")
+	// the server flags add a server only when given
+	serverSet := false
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "server", "serverkey", "serversigkey", "peers":
+			serverSet = true
+		}
+	})
+	if !serverSet {
+		server = nil
+	}
 	restString := fmt.Sprintf("localhost:%d", restPort)
 
 	node := qldb.New(new(ecc.KeyPair), new(ecc.KeyPair))
-	node.BootstrapDB(dbFile)
+	db := node.BootstrapDB(dbFile)
 
 	certfile := "cert.pem"
 	keyfile := "key.pem"
@@ -116,5 +142,5 @@ func main() {
 		log.Fatal(err)
 	}
 
-	serve(tls.New(cert, key, node, true), node, restString, certfile, keyfile)
+	serve(tls.New(cert, key, node, true), node, db, maxSkew, server, restString, certfile, keyfile)
 }
@@ -4,6 +4,8 @@ import (
 	"errors"
 	"log"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/awgh/bencrypt/ecc"
 	"github.com/awgh/hushcom"
@@ -22,22 +24,10 @@ func jaserr(ctx *jas.Context, err error) {
 	}
 }
 
-// Poll - Hacky AJAX endpoint, todo: replace me with web sockets
-type Poll struct {
-	hc *client.Client
-}
-
-func newPoll(hc *client.Client) *Poll {
-	p := new(Poll)
-	p.hc = hc
-	return p
-}
-
-// Get poll updates
-func (p *Poll) Get(ctx *jas.Context) { // `GET /v1/poll`
-	ctx.Data = p.hc.Output
-	p.hc.Output = ""
-	//log.Println("poll result: ", ctx.Data)
+// findNetwork - the optional Network parameter, or the one connected server if it's missing
+func findNetwork(ctx *jas.Context, hc *client.Client) (string, error) {
+	network, _ := ctx.FindString("Network")
+	return hc.ResolveNetwork(network)
 }
 
 // Profile - Rest Calls for Profiles
@@ -66,9 +56,7 @@ func (p *Profile) PutLoad(ctx *jas.Context) { // `PUT /v1/profile/load`
 	*/
 	name := ctx.RequireString("Name")
 
-	key, err := p.hc.Node.LoadProfile(name)
-	p.hc.CurrentProfileName = name
-	p.hc.CurrentProfilePubKey = key
+	err := p.hc.LoadProfile(name)
 	ctx.Data = "OK"
 	jaserr(ctx, err)
 }
@@ -162,7 +150,52 @@ func (c *Channel) PostDelete(ctx *jas.Context) { // `POST /v1/channel/delete`
 		body:  Name=abc
 	*/
 	name := ctx.RequireString("Name")
-	err := c.hc.Node.DeleteChannel(name)
+	err := c.hc.LeaveChannel(name)
+	ctx.Data = "OK"
+	jaserr(ctx, err)
+}
+
+// PostRotate - Rotate a channel's key, handing the new key to the given members
+func (c *Channel) PostRotate(ctx *jas.Context) { // `POST /v1/channel/rotate`
+	/*
+		body:  Name=abc&Members=nick1,nick2
+	*/
+	name := ctx.RequireString("Name")
+	var members []string
+	if m, err := ctx.FindString("Members"); err == nil && m != "" {
+		members = strings.Split(m, ",")
+	}
+	err := c.hc.RotateChannelKey(ctx.Request.Context(), name, members)
+	ctx.Data = "OK"
+	jaserr(ctx, err)
+}
+
+// GetRequests - List join requests for private channels waiting on approval
+func (c *Channel) GetRequests(ctx *jas.Context) { // `GET /v1/channel/requests`
+	/*
+		query:  Name=abc (optional, all channels if omitted)
+	*/
+	name, _ := ctx.FindString("Name")
+	ctx.Data = c.hc.GetJoinRequests(name)
+}
+
+// PostRequests - Approve or deny a join request
+func (c *Channel) PostRequests(ctx *jas.Context) { // `POST /v1/channel/requests/approve|deny`
+	/*
+		body:  Name=abc&User=nick
+	*/
+	name := ctx.RequireString("Name")
+	user := ctx.RequireString("User")
+
+	var err error
+	switch ctx.PathSegment(2) {
+	case "approve":
+		err = c.hc.AnswerJoinRequest(name, user, true)
+	case "deny":
+		err = c.hc.AnswerJoinRequest(name, user, false)
+	default:
+		err = errors.New("Unknown join request action: " + ctx.PathSegment(2))
+	}
 	ctx.Data = "OK"
 	jaserr(ctx, err)
 }
@@ -175,16 +208,225 @@ func (c *Channel) Post(ctx *jas.Context) { // `POST /v1/channel`
 	name := ctx.RequireString("Name")
 	msg := ctx.RequireString("Data")
 
-	var req hushcom.ChannelMsg
-	req.Channel = name
-	req.Text = msg
+	err := c.hc.SendChannelMsg(name, msg)
+	ctx.Data = "OK"
+	jaserr(ctx, err)
+}
+
+// GetHistory - Get a page of a channel's stored messages, newest first
+func (c *Channel) GetHistory(ctx *jas.Context) { // `GET /v1/channel/history`
+	/*
+		query:  Name=abc&Before=123&Limit=50&Network=srv  (Before, Limit and Network are optional)
+	*/
+	name := ctx.RequireString("Name")
+	network, err := findNetwork(ctx, c.hc)
+	if err != nil {
+		jaserr(ctx, err)
+		return
+	}
+	var before int64
+	var limit int
+	if b, err := ctx.FindString("Before"); err == nil && b != "" {
+		if before, err = strconv.ParseInt(b, 10, 64); err != nil {
+			jaserr(ctx, err)
+			return
+		}
+	}
+	if l, err := ctx.FindString("Limit"); err == nil && l != "" {
+		if limit, err = strconv.Atoi(l); err != nil {
+			jaserr(ctx, err)
+			return
+		}
+	}
+	result, err := c.hc.GetHistory(network, name, before, limit)
+	ctx.Data = result
+	jaserr(ctx, err)
+}
+
+// GetRetention - Get a channel's history retention policy
+func (c *Channel) GetRetention(ctx *jas.Context) { // `GET /v1/channel/retention`
+	/*
+		query:  Name=abc&Network=srv  (Network is optional)
+	*/
+	name := ctx.RequireString("Name")
+	network, err := findNetwork(ctx, c.hc)
+	if err != nil {
+		jaserr(ctx, err)
+		return
+	}
+	result, err := c.hc.GetHistoryPolicy(network, name)
+	ctx.Data = result
+	jaserr(ctx, err)
+}
+
+// PutRetention - Set a channel's history retention policy
+func (c *Channel) PutRetention(ctx *jas.Context) { // `PUT /v1/channel/retention`
+	/*
+		body:  Name=abc&MaxAge=720h&MaxCount=1000&Network=srv  (MaxAge, MaxCount and Network are optional, -1 MaxCount keeps nothing)
+	*/
+	policy := &client.HistoryPolicy{Channel: ctx.RequireString("Name")}
+	var err error
+	if policy.Network, err = findNetwork(ctx, c.hc); err != nil {
+		jaserr(ctx, err)
+		return
+	}
+	if a, err := ctx.FindString("MaxAge"); err == nil && a != "" {
+		if policy.MaxAge, err = time.ParseDuration(a); err != nil {
+			jaserr(ctx, err)
+			return
+		}
+	}
+	if n, err := ctx.FindString("MaxCount"); err == nil && n != "" {
+		if policy.MaxCount, err = strconv.Atoi(n); err != nil {
+			jaserr(ctx, err)
+			return
+		}
+	}
+	err = c.hc.SetHistoryPolicy(policy)
+	ctx.Data = "OK"
+	jaserr(ctx, err)
+}
+
+// User - Rest Calls for Users
+type User struct {
+	hc *client.Client
+}
+
+func newUser(hc *client.Client) *User {
+	p := new(User)
+	p.hc = hc
+	return p
+}
+
+// PostMessage - Send a private message to a user
+func (u *User) PostMessage(ctx *jas.Context) { // `POST /v1/user/message`
+	/*
+		body:  Name=abc&Data=message_data&Network=srv  (Network is optional while one server is connected)
+	*/
+	name := ctx.RequireString("Name")
+	msg := ctx.RequireString("Data")
+	network, _ := ctx.FindString("Network")
+
+	err := u.hc.NewPrivMsg(network, name, msg)
+	ctx.Data = "OK"
+	jaserr(ctx, err)
+}
+
+// Contact - Rest Calls for pinned contact keys
+type Contact struct {
+	hc *client.Client
+}
+
+func newContact(hc *client.Client) *Contact {
+	p := new(Contact)
+	p.hc = hc
+	return p
+}
+
+// Get - List the loaded profile's pinned contact keys
+func (c *Contact) Get(ctx *jas.Context) { // `GET /v1/contact`
+	result, err := c.hc.GetContactKeys()
+	ctx.Data = result
+	jaserr(ctx, err)
+}
+
+// GetFingerprint - Fingerprints, safety number and its QR string for a pinned contact
+func (c *Contact) GetFingerprint(ctx *jas.Context) { // `GET /v1/contact/fingerprint`
+	/*
+		query:  Name=nick&Network=srv  (Network is optional while one server is connected)
+	*/
+	name := ctx.RequireString("Name")
+	network, err := findNetwork(ctx, c.hc)
+	if err != nil {
+		jaserr(ctx, err)
+		return
+	}
+	result, err := c.hc.GetContactFingerprint(network, name)
+	ctx.Data = result
+	jaserr(ctx, err)
+}
+
+// PostVerify - Mark a contact's pinned key as confirmed out of band
+func (c *Contact) PostVerify(ctx *jas.Context) { // `POST /v1/contact/verify`
+	/*
+		body:  Name=nick&SafetyNumber=12345...&Network=srv  (SafetyNumber is optional, checked if given, Network is optional while one server is connected)
+	*/
+	name := ctx.RequireString("Name")
+	safetyNumber, _ := ctx.FindString("SafetyNumber")
+	network, err := findNetwork(ctx, c.hc)
+	if err != nil {
+		jaserr(ctx, err)
+		return
+	}
+	err = c.hc.VerifyContactKey(network, name, safetyNumber)
+	ctx.Data = "OK"
+	jaserr(ctx, err)
+}
 
-	err := c.hc.HCSend("Channel", true, name,
-		c.hc.CurrentProfilePubKey, nil, req)
+// PostReset - Forget a contact's pinned key, the next key seen for them is pinned instead
+func (c *Contact) PostReset(ctx *jas.Context) { // `POST /v1/contact/reset`
+	/*
+		body:  Name=nick&Network=srv  (Network is optional while one server is connected)
+	*/
+	name := ctx.RequireString("Name")
+	network, err := findNetwork(ctx, c.hc)
+	if err != nil {
+		jaserr(ctx, err)
+		return
+	}
+	err = c.hc.ResetContactKey(network, name)
 	ctx.Data = "OK"
 	jaserr(ctx, err)
 }
 
+// Search - Rest Calls for searching local message history
+type Search struct {
+	hc *client.Client
+}
+
+func newSearch(hc *client.Client) *Search {
+	p := new(Search)
+	p.hc = hc
+	return p
+}
+
+// parseTime - RFC3339, or nanoseconds since the epoch
+func parseTime(s string) (time.Time, error) {
+	if ns, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(0, ns), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// Get - Search local message history, newest first
+func (s *Search) Get(ctx *jas.Context) { // `GET /v1/search`
+	/*
+		query:  Text=words&Network=srv&Channel=abc&From=nick&Since=2020-01-02T15:04:05Z&Until=...&Limit=50  (all optional)
+	*/
+	var q client.SearchQuery
+	q.Text, _ = ctx.FindString("Text")
+	q.Network, _ = ctx.FindString("Network")
+	q.Channel, _ = ctx.FindString("Channel")
+	q.From, _ = ctx.FindString("From")
+	for param, t := range map[string]*time.Time{"Since": &q.Since, "Until": &q.Until} {
+		if v, err := ctx.FindString(param); err == nil && v != "" {
+			if *t, err = parseTime(v); err != nil {
+				jaserr(ctx, err)
+				return
+			}
+		}
+	}
+	if l, err := ctx.FindString("Limit"); err == nil && l != "" {
+		if q.Limit, err = strconv.Atoi(l); err != nil {
+			jaserr(ctx, err)
+			return
+		}
+	}
+	result, err := s.hc.Search(q)
+	ctx.Data = result
+	jaserr(ctx, err)
+}
+
 // Remote - Rest Calls to interact with Hushcom Server
 type Remote struct {
 	hc *client.Client
@@ -196,21 +438,85 @@ func newRemote(hc *client.Client) *Remote {
 	return p
 }
 
+// Remote calls take an optional Network=srv parameter, naming the Hushcom Server to talk to.
+// It can be left out while only one server is connected. Register, channel list, create, members
+// and admin calls wait for the server's reply, and return its result.
+
 // PutRegister -  Register loaded user name/key with Hushcom Server
 func (r *Remote) PutRegister(ctx *jas.Context) { // `PUT /v1/remote/register`
 	if r.hc.CurrentProfileName == "" {
 		ctx.Error = jas.NewRequestError("No Profile Loaded")
 		return
 	}
-	log.Println("Creating Register Profile with: ", r.hc.CurrentProfileName, client.HUSHCOM, r.hc.CurrentProfilePubKey)
-	err := r.hc.NewRegisterMsg()
+	network, _ := ctx.FindString("Network")
+	log.Println("Creating Register Profile with: ", r.hc.CurrentProfileName, network, r.hc.CurrentProfilePubKey)
+	err := r.hc.Register(ctx.Request.Context(), network)
 	ctx.Data = "OK"
 	jaserr(ctx, err)
 }
 
 // PutUnregister -  Unregister loaded user name/key with Hushcom Server
 func (r *Remote) PutUnregister(ctx *jas.Context) { // `PUT /v1/remote/unregister`
-	err := r.hc.NewUnregisterMsg()
+	network, _ := ctx.FindString("Network")
+	err := r.hc.NewUnregisterMsg(network)
+	ctx.Data = "OK"
+	jaserr(ctx, err)
+}
+
+// GetNetwork -  Registration state and channel list of each connected Hushcom Server
+func (r *Remote) GetNetwork(ctx *jas.Context) { // `GET /v1/remote/network`
+	ctx.Data = r.hc.GetNetworks()
+}
+
+// GetServer -  List the configured Hushcom Servers
+func (r *Remote) GetServer(ctx *jas.Context) { // `GET /v1/remote/server`
+	servers, err := r.hc.GetServers()
+	ctx.Data = servers
+	jaserr(ctx, err)
+}
+
+// PutServer -  Add or update a Hushcom Server and connect to it
+func (r *Remote) PutServer(ctx *jas.Context) { // `PUT /v1/remote/server`
+	/*
+		body:  Name=abc&PubKey=b64&SigKey=b64&Peers=host:port,host:port
+	*/
+	cfg := &client.ServerConfig{
+		Name:   ctx.RequireString("Name"),
+		PubKey: ctx.RequireString("PubKey"),
+		SigKey: ctx.RequireString("SigKey"),
+	}
+	if p, err := ctx.FindString("Peers"); err == nil && p != "" {
+		cfg.Peers = strings.Split(p, ",")
+	}
+	err := r.hc.SetServer(cfg)
+	ctx.Data = "OK"
+	jaserr(ctx, err)
+}
+
+// PostServer -  Connect to or disconnect from a configured Hushcom Server
+func (r *Remote) PostServer(ctx *jas.Context) { // `POST /v1/remote/server/connect|disconnect`
+	/*
+		body:  Name=abc
+	*/
+	name := ctx.RequireString("Name")
+
+	var err error
+	switch ctx.PathSegment(2) {
+	case "connect":
+		err = r.hc.ConnectServer(name)
+	case "disconnect":
+		err = r.hc.DisconnectServer(name)
+	default:
+		err = errors.New("Unknown server action: " + ctx.PathSegment(2))
+	}
+	ctx.Data = "OK"
+	jaserr(ctx, err)
+}
+
+// DeleteServer -  Forget a configured Hushcom Server
+func (r *Remote) DeleteServer(ctx *jas.Context) { // `DELETE /v1/remote/server`
+	name := ctx.RequireString("Name")
+	err := r.hc.DeleteServer(name)
 	ctx.Data = "OK"
 	jaserr(ctx, err)
 }
@@ -222,36 +528,131 @@ func (r *Remote) GetChannel(ctx *jas.Context) { // `GET /v1/remote/channel`
 		jaserr(ctx, err)
 		return
 	}
-	err := r.hc.NewListChansMsg()
-	ctx.Data = "OK"
+	if ctx.PathSegment(2) == "members" {
+		r.getChannelMembers(ctx)
+		return
+	}
+	network, _ := ctx.FindString("Network")
+	result, err := r.hc.ListChannels(ctx.Request.Context(), network)
+	ctx.Data = result
+	jaserr(ctx, err)
+}
+
+// GetUser -  Look up a registered user's keys on Hushcom Server
+func (r *Remote) GetUser(ctx *jas.Context) { // `GET /v1/remote/user?Name=abc`
+	if r.hc.CurrentProfileName == "" {
+		err := errors.New("No Profile Loaded")
+		jaserr(ctx, err)
+		return
+	}
+	name := ctx.RequireString("Name")
+	network, _ := ctx.FindString("Network")
+	result, err := r.hc.Whois(ctx.Request.Context(), network, name)
+	ctx.Data = result
+	jaserr(ctx, err)
+}
+
+// getChannelMembers -  Get a channel's admins and members from Hushcom Server
+func (r *Remote) getChannelMembers(ctx *jas.Context) { // `GET /v1/remote/channel/members?Name=abc`
+	name := ctx.RequireString("Name")
+	result, err := r.hc.ChannelMembers(ctx.Request.Context(), name)
+	ctx.Data = result
 	jaserr(ctx, err)
 }
 
 // PutChannel -  Register a new channel on Hushcom Server
 func (r *Remote) PutChannel(ctx *jas.Context) { // `PUT /v1/remote/channel`
+	/*
+		body:  Name=abc&Private=0&Password=pwd&Network=srv  (Private, Password and Network are optional)
+	*/
 	name := ctx.RequireString("Name") // Name of channel to create
+	private := false
+	if p, err := ctx.FindString("Private"); err == nil && p != "" {
+		var err error
+		if private, err = strconv.ParseBool(p); err != nil {
+			jaserr(ctx, err)
+			return
+		}
+	}
+	password, _ := ctx.FindString("Password")
+	network, err := findNetwork(ctx, r.hc)
+	if err != nil {
+		jaserr(ctx, err)
+		return
+	}
+	if err := r.hc.ClaimChannel(network, name); err != nil {
+		jaserr(ctx, err)
+		return
+	}
+	cfg := &client.ChannelConfig{Name: name, Private: private, Network: network}
+	if password != "" {
+		hash, err := hushcom.HashPassword(password)
+		if err != nil {
+			jaserr(ctx, err)
+			return
+		}
+		cfg.Password = hash
+	}
+	if err := r.hc.SetChannelConfig(cfg); err != nil {
+		jaserr(ctx, err)
+		return
+	}
 	// Generate a new channel keypair
 	chanCrypt := new(ecc.KeyPair)
 	chanCrypt.GenerateKey()
 	pubkey := chanCrypt.GetPubKey().ToB64()
 	// Save this channel to local DB. todo: remove this if NewChan fails
-	err := r.hc.Node.AddChannel(name, chanCrypt.ToB64())
+	err = r.hc.Node.AddChannel(name, chanCrypt.ToB64())
 	jaserr(ctx, err)
 	if err == nil {
 		// Create and send new channel message with new keypair
 
 		log.Println("NewNewChanMsg with pubkey: ", pubkey)
 
-		err := r.hc.NewNewChanMsg(name, pubkey)
+		err := r.hc.CreateChannel(ctx.Request.Context(), name, pubkey)
 		ctx.Data = "OK"
 		jaserr(ctx, err)
 	}
 }
 
+// chanAdminActions - URL segments for channel administration, mapped to message types
+var chanAdminActions = map[string]string{
+	"kick":  "Kick",
+	"ban":   "Ban",
+	"unban": "Unban",
+	"op":    "Op",
+	"deop":  "Deop",
+	"owner": "TransferOwner",
+}
+
+// PostChannel - Channel administration on Hushcom Server (channel admins only)
+func (r *Remote) PostChannel(ctx *jas.Context) { // `POST /v1/remote/channel/kick|ban|unban|op|deop|owner`
+	/*
+		body:  Name=abc&User=nick
+	*/
+	if r.hc.CurrentProfileName == "" {
+		err := errors.New("No Profile Loaded")
+		jaserr(ctx, err)
+		return
+	}
+	name := ctx.RequireString("Name")
+	user := ctx.RequireString("User")
+
+	action, ok := chanAdminActions[ctx.PathSegment(2)]
+	if !ok {
+		jaserr(ctx, errors.New("Unknown channel admin action: "+ctx.PathSegment(2)))
+		return
+	}
+	result, err := r.hc.AdminChannel(ctx.Request.Context(), action, name, user)
+	ctx.Data = result
+	jaserr(ctx, err)
+}
+
 // PostChannelJoin - Send a join request to channel
 func (r *Remote) PostChannelJoin(ctx *jas.Context) { // `POST /v1/remote/channel_join`
 	/*
-		body:  Name=abc&Password=pwd&Key=b64pubkey
+		body:  Name=abc&Password=pwd&Key=b64pubkey&Network=srv&Responder=nick  (Password, Network and Responder are optional,
+		Responder is required for a private channel)
 	*/
 	var password string
 	name := ctx.RequireString("Name")
@@ -262,7 +663,9 @@ func (r *Remote) PostChannelJoin(ctx *jas.Context) { // `POST /v1/remote/channel
 	err := key.FromB64(keyA)
 	jaserr(ctx, err)
 	if err == nil {
-		err = r.hc.NewJoinChanMsg(name, key, password)
+		network, _ := ctx.FindString("Network")
+		responder, _ := ctx.FindString("Responder")
+		err = r.hc.NewJoinChanMsg(ctx.Request.Context(), network, name, key, password, responder)
 		ctx.Data = "OK"
 		jaserr(ctx, err)
 	}
@@ -1,15 +1,19 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"database/sql"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/awgh/bencrypt/bc"
 	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/hushcom"
 	"github.com/awgh/hushcom/server"
 	"github.com/awgh/ratnet/api"
 	"github.com/awgh/ratnet/nodes/qldb"
@@ -31,28 +35,92 @@ func serve(transportPublic api.Transport, node api.Node, listenPublic string) {
 
 var db func() *sql.DB
 
+// parseTypeLimits - "Register=2:5,NewChan=6:10" into per-minute rates and bursts by message type
+func parseTypeLimits(s string, limits map[string]server.Limit) error {
+	for _, item := range strings.Split(s, ",") {
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("bad type limit %q, want Type=perMinute:burst", item)
+		}
+		rb := strings.SplitN(kv[1], ":", 2)
+		rate, err := strconv.ParseFloat(rb[0], 64)
+		if err != nil {
+			return fmt.Errorf("bad type limit %q: %v", item, err)
+		}
+		burst := 1
+		if len(rb) == 2 {
+			if burst, err = strconv.Atoi(rb[1]); err != nil {
+				return fmt.Errorf("bad type limit %q: %v", item, err)
+			}
+		}
+		limits[kv[0]] = server.PerMinute(rate, burst)
+	}
+	return nil
+}
+
 func main() {
 	var dbFile string
 	var publicPort int
+	var maxSkew time.Duration
+	var workers, senderQueue, maxMsgSize int
+	var errorReplies bool
+	var statsEvery time.Duration
+	limits := server.DefaultLimits()
+	var typeLimits string
 
 	flag.StringVar(&dbFile, "dbfile", "ratnet.ql", "QL Database File")
 	flag.IntVar(&publicPort, "p", 20001, "HTTPS Public Port (*)")
+	flag.DurationVar(&maxSkew, "skew", hushcom.DefaultMaxSkew, "Max Message Clock Skew (0 disables)")
+	flag.IntVar(&workers, "workers", server.DefaultWorkers, "Message Handling Goroutines")
+	flag.IntVar(&senderQueue, "queue", server.DefaultSenderQueue, "Max Queued Messages per Sender")
+	flag.IntVar(&maxMsgSize, "maxmsg", server.DefaultMaxMsgSize, "Max Message Size (bytes)")
+	flag.BoolVar(&errorReplies, "errorreplies", true, "Send ErrorResp to Senders of Rejected Messages")
+	flag.DurationVar(&statsEvery, "stats", 5*time.Minute, "Rejected Message Count Log Interval (0 disables)")
+	flag.Float64Var(&limits.Global.Rate, "globalrate", limits.Global.Rate, "Max Messages per Second, All Senders (0 disables)")
+	flag.IntVar(&limits.Global.Burst, "globalburst", limits.Global.Burst, "Max Message Burst, All Senders")
+	flag.Float64Var(&limits.PerNick.Rate, "rate", limits.PerNick.Rate, "Max Messages per Second per Sender (0 disables)")
+	flag.IntVar(&limits.PerNick.Burst, "burst", limits.PerNick.Burst, "Max Message Burst per Sender")
+	flag.StringVar(&typeLimits, "typelimits", "", "Per Sender Limits by Message Type, e.g. Register=2:5,NewChan=6:10 (per minute:burst, 0 disables)")
+	flag.IntVar(&limits.MaxChansPerUser, "maxchans", limits.MaxChansPerUser, "Max Channels Owned per User (0 disables)")
 	flag.Parse()
 	publicString := fmt.Sprintf(":%d", publicPort)
+	if err := parseTypeLimits(typeLimits, limits.PerType); err != nil {
+		log.Fatal(err.Error())
+	}
 
 	node := qldb.New(new(ecc.KeyPair), new(ecc.KeyPair))
 	db = node.BootstrapDB(dbFile)
 
-	serverInst := server.New(node)
+	serverInst := server.New(node, db)
+	serverInst.Replay.MaxSkew = maxSkew
+	serverInst.MaxMsgSize = maxMsgSize
+	serverInst.ErrorReplies = errorReplies
+	serverInst.Limits = limits
+	if err := serverInst.Load(); err != nil {
+		log.Fatal(err.Error())
+	}
+	pool := serverInst.NewWorkers(workers)
+	pool.MaxQueue = senderQueue
 	go func() {
 		for {
 			msg := <-node.Out()
-			if err := serverInst.HandleMsg(msg); err != nil {
+			if err := pool.HandleMsg(msg); err != nil {
 				log.Println("hushcomd ratnet bg thread: " + err.Error())
-				log.Println(msg)
 			}
 		}
 	}()
+	if statsEvery > 0 {
+		go func() {
+			for range time.Tick(statsEvery) {
+				if rejected := serverInst.Rejected(); len(rejected) > 0 {
+					log.Println("Rejected messages by error code: ", rejected)
+				}
+			}
+		}()
+	}
 
 	// print public content key
 	pubsrv, err := node.CID()
@@ -60,6 +128,11 @@ func main() {
 		log.Fatal(err.Error())
 	}
 	log.Println("Public Content Key: ", pubsrv.ToB64())
+	sigsrv, err := serverInst.SigningKey()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	log.Println("Public Signing Key: ", hushcom.SigKeyToB64(sigsrv.Public().(ed25519.PublicKey)))
 
 	certfile := "cert.pem"
 	keyfile := "key.pem"
@@ -1,10 +1,19 @@
 package hushcom
 
 import (
-	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/awgh/bencrypt/bc"
+	"github.com/awgh/bencrypt/ecc"
 )
 
 // Msg - Core message struct for HC messages
@@ -12,8 +21,9 @@ type Msg struct {
 	From      string // nick of sender, signed by sender
 	Timestamp int64  // timestamp set and signed by sender
 	MsgType   string // verb, signed by sender
+	RequestID string // optional, set by sender and signed, echoed in the server's replies
 	Data      []byte // inner data, typically JSON
-	Sig       []byte // signature of (From + Timestamp + MsgType + msg)
+	Sig       []byte // ed25519 signature of (From + Timestamp + MsgType + RequestID + msg)
 }
 
 // SignMe - convert a message to a byte array for signing purposes only
@@ -24,15 +34,38 @@ func (inst Msg) SignMe() []byte {
 	binary.LittleEndian.PutUint64(b, uint64(inst.Timestamp))
 	output = append(output, b...)
 	output = append(output, []byte(inst.MsgType)...)
+	// length first, so bytes can't be moved between RequestID and Data
+	binary.LittleEndian.PutUint64(b, uint64(len(inst.RequestID)))
+	output = append(output, b...)
+	output = append(output, []byte(inst.RequestID)...)
 	output = append(output, inst.Data...)
 	return output
 }
 
+// CorrelationID - Identifies a message to its sender in the server's replies:
+// its RequestID, or its Timestamp if it has none
+func (inst Msg) CorrelationID() string {
+	if inst.RequestID != "" {
+		return inst.RequestID
+	}
+	return strconv.FormatInt(inst.Timestamp, 10)
+}
+
+// NewRequestID - Random RequestID for a message that expects a reply
+func NewRequestID() (string, error) {
+	b, err := bc.GenerateRandomBytes(16)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
 // Messages
 
 // RegisterMsg - Register a new user/pubkey pair
 type RegisterMsg struct {
-	Key string // b64 pubkey
+	Key    string // b64 pubkey
+	SigKey string // b64 ed25519 signing pubkey
 }
 
 // RegisterRespMsg - Registration response message
@@ -44,20 +77,27 @@ type RegisterRespMsg struct {
 type NewChanMsg struct {
 	ChanName     string
 	ChanPubKey   string // b64 pubkey
-	ChanPassword string
+	ChanSigKey   string // b64 ed25519 signing pubkey derived from the channel key
+	ChanPassword string // salted password hash from HashPassword, never plaintext
+	Private      bool   // hidden from ListChans
 }
 
 // JoinChanMsg - Join channel request
 type JoinChanMsg struct {
 	Channel   string
 	ReqPubKey string // b64 pubkey
+	ReqSigKey string // b64 ed25519 signing pubkey
 	Password  string
+	Responder string // channel admin asked to answer, everyone else ignores the request
 }
 
 // JoinChanRespMsg - Join channel response
 type JoinChanRespMsg struct {
-	Channel    string
-	ChannelKey string // this should be base64 encoded
+	Channel      string
+	ChannelKey   string // this should be base64 encoded
+	ChanPassword string // salted password hash, so the new member can check later joins
+	Private      bool   // joins need approval from a member
+	Denied       bool   // request was rejected, ChannelKey is empty
 }
 
 // ChannelMsg - Message in a channel
@@ -66,10 +106,103 @@ type ChannelMsg struct {
 	Text    string
 }
 
+// PrivMsg - Private message to a single user
+type PrivMsg struct {
+	To   string
+	Text string
+}
+
+// WhoisMsg - Look up a registered user's keys
+type WhoisMsg struct {
+	Name string
+}
+
+// WhoisRespMsg - Whois response
+type WhoisRespMsg struct {
+	Name   string
+	Found  bool
+	Key    string // b64 pubkey
+	SigKey string // b64 ed25519 signing pubkey
+}
+
+// ChanKeyMsg - New channel key, sent by an admin to each remaining member on rotation
+type ChanKeyMsg struct {
+	Channel    string
+	ChannelKey string // this should be base64 encoded
+	Proof      []byte // ChanKeyProof of the new key, made with the old channel key
+}
+
+// RotateChanKeyMsg - Register a channel's new pubkey with the server
+type RotateChanKeyMsg struct {
+	ChanName   string
+	ChanPubKey string // b64 pubkey
+	ChanSigKey string // b64 ed25519 signing pubkey derived from the channel key
+}
+
+// RotateChanKeyRespMsg - The server took a channel's new pubkey
+type RotateChanKeyRespMsg struct {
+	ChanName string
+}
+
+// ChanJoinedMsg - Tell the server we have joined a channel
+type ChanJoinedMsg struct {
+	Channel string
+	Proof   []byte // ChanMemberProof, shows we hold the channel key
+}
+
+// ChanPartMsg - Tell the server we have left a channel
+type ChanPartMsg struct {
+	Channel string
+}
+
+// NamesMsg - Ask the server for a channel's members
+type NamesMsg struct {
+	Channel string
+}
+
+// NamesRespMsg - Channel members response
+type NamesRespMsg struct {
+	Channel    string
+	Owner      string
+	Admins     []string
+	Users      []string
+	Bans       []string
+	ChanSigKey string // b64 ed25519 signing pubkey of the channel's current key, see RotateChanKeyMsg
+}
+
+// ChanAdminMsg - Channel administration request, sent as one of the
+// Kick, Ban, Unban, Op, Deop or TransferOwner message types
+type ChanAdminMsg struct {
+	Channel string
+	Nick    string
+}
+
+// ChanAdminRespMsg - Result of a channel administration request,
+// sent to the admin who made it and to the affected user
+type ChanAdminRespMsg struct {
+	Action  string // the request's message type
+	Channel string
+	Nick    string // affected user
+	By      string // admin who made the request
+	Owner   string
+	Admins  []string
+	Users   []string
+	Bans    []string
+}
+
+// ChanAdminActions - Message types that carry a ChanAdminMsg
+var ChanAdminActions = []string{"Kick", "Ban", "Unban", "Op", "Deop", "TransferOwner"}
+
 // Channel - Common Representation of a Channel
 type Channel struct {
-	Name   string
-	PubKey string // this should be base64 encoded
+	Name        string
+	PubKey      string // this should be base64 encoded
+	HasPassword bool   // joining requires a password
+}
+
+// NewChanRespMsg - The channel was created
+type NewChanRespMsg struct {
+	ChanName string
 }
 
 // ListChansRespMsg - List channels response
@@ -77,23 +210,168 @@ type ListChansRespMsg struct {
 	Channels []Channel
 }
 
+// Error codes carried by ErrorRespMsg
+const (
+	ErrCodeTooLarge        = "TooLarge"        // over the server's message size limit
+	ErrCodeMalformed       = "Malformed"       // could not be decoded
+	ErrCodeUnauthenticated = "Unauthenticated" // unknown sender or bad signature
+	ErrCodeReplayed        = "Replayed"        // stale or duplicate
+	ErrCodeUnknownType     = "UnknownType"     // no handler for the message type
+	ErrCodeRefused         = "Refused"         // well formed, but not allowed or not possible
+	ErrCodeQueueFull       = "QueueFull"       // the sender has too many messages waiting
+	ErrCodeThrottled       = "Throttled"       // over a rate limit, sent once until messages get through again
+	ErrCodeInternal        = "Internal"        // the server failed to handle it
+)
+
+// ErrorRespMsg - The server rejected a message
+type ErrorRespMsg struct {
+	Code          string // one of the ErrCode constants
+	MsgType       string // type of the rejected message
+	CorrelationID string // CorrelationID of the rejected message
+	Error         string
+}
+
 var (
 	hcKeyLabel = []byte{
 		0x8b, 0xbb, 0xaa, 0xf0, 0x93, 0xe9, 0x43, 0x54,
 		0xa8, 0x76, 0xd8, 0x56, 0x30, 0x6b, 0x37, 0x25}
+
+	hcChanKeyLabel = []byte{
+		0x3d, 0x5c, 0x1e, 0x97, 0x6a, 0x0f, 0x4b, 0x21,
+		0x9e, 0x42, 0xc7, 0x18, 0x85, 0xd3, 0x60, 0xfa}
 )
 
-// SignMsg - Sign a message (key is not base64 here)
-func SignMsg(key bc.PubKey, msg Msg) ([]byte, error) {
-	//log.Println("SignMsg, key:", key)
-	return bc.Kdf(msg.SignMe(), hcKeyLabel, key.ToBytes())
+// SigningKey - Derive the ed25519 signing key bound to a keypair (b64 as stored by ratnet)
+func SigningKey(keyPairB64 string) (ed25519.PrivateKey, error) {
+	kb, err := base64.StdEncoding.DecodeString(keyPairB64)
+	if err != nil {
+		return nil, err
+	}
+	if len(kb) == 0 {
+		return nil, errors.New("Empty keypair in SigningKey")
+	}
+	seed, err := bc.Kdf(kb, hcKeyLabel, nil)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// SigKeyToB64 - Encode an ed25519 signing pubkey as base64
+func SigKeyToB64(key ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// SigKeyFromB64 - Decode a base64 ed25519 signing pubkey
+func SigKeyFromB64(s string) (ed25519.PublicKey, error) {
+	kb, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(kb) != ed25519.PublicKeySize {
+		return nil, errors.New("Key array wrong size in SigKeyFromB64")
+	}
+	return ed25519.PublicKey(kb), nil
+}
+
+// ChanKeyProof - Proof that whoever hands out a new channel key also held the old one
+func ChanKeyProof(oldChanKeyB64 string, newChanKeyB64 string) ([]byte, error) {
+	newKey := new(ecc.KeyPair)
+	if err := newKey.FromB64(newChanKeyB64); err != nil {
+		return nil, err
+	}
+	return bc.Kdf([]byte(oldChanKeyB64), hcChanKeyLabel, newKey.GetPubKey().ToBytes())
+}
+
+// ChanSigKey - Get the b64 ed25519 signing pubkey derived from a channel keypair
+func ChanSigKey(chanKeyB64 string) (string, error) {
+	sk, err := SigningKey(chanKeyB64)
+	if err != nil {
+		return "", err
+	}
+	return SigKeyToB64(sk.Public().(ed25519.PublicKey)), nil
+}
+
+func chanMemberData(channel, nick string) []byte {
+	return []byte(channel + "\x00" + nick)
 }
 
-// VerifyMsg - Verify a message signature
-func VerifyMsg(key bc.PubKey, msg Msg) bool {
-	sig, err := SignMsg(key, msg)
+// ChanMemberProof - Sign (channel, nick) with the channel's derived signing key, proving nick holds the channel key
+func ChanMemberProof(chanKeyB64 string, channel, nick string) ([]byte, error) {
+	sk, err := SigningKey(chanKeyB64)
 	if err != nil {
+		return nil, err
+	}
+	return ed25519.Sign(sk, chanMemberData(channel, nick)), nil
+}
+
+// VerifyChanMemberProof - Verify a ChanMemberProof against the channel's signing pubkey
+func VerifyChanMemberProof(chanSigKey ed25519.PublicKey, channel, nick string, proof []byte) bool {
+	if len(chanSigKey) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(chanSigKey, chanMemberData(channel, nick), proof)
+}
+
+// Fingerprint - Readable fingerprint of a signing pubkey: the first 20 bytes
+// of its SHA-256 in upper case hex, in groups of four
+func Fingerprint(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	h := strings.ToUpper(hex.EncodeToString(sum[:20]))
+	var groups []string
+	for i := 0; i < len(h); i += 4 {
+		groups = append(groups, h[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
+
+// safetyNumberIterations - hash rounds per key, slows down searching for look-alike keys
+const safetyNumberIterations = 1024
+
+// safetyDigits - 30 digits for one user: six 5-digit groups from an iterated hash of nick and key
+func safetyDigits(nick string, key ed25519.PublicKey) string {
+	h := sha512.Sum512(append([]byte(nick+"\x00"), key...))
+	for i := 1; i < safetyNumberIterations; i++ {
+		h = sha512.Sum512(append(h[:], key...))
+	}
+	var groups []string
+	for i := 0; i < 30; i += 5 {
+		var n uint64
+		for _, b := range h[i : i+5] {
+			n = n<<8 | uint64(b)
+		}
+		groups = append(groups, fmt.Sprintf("%05d", n%100000))
+	}
+	return strings.Join(groups, " ")
+}
+
+// SafetyNumber - 60 digit number for a pair of users, the same on both sides.
+// If both users see the same number, each holds the other's real signing key.
+func SafetyNumber(nickA string, keyA ed25519.PublicKey, nickB string, keyB ed25519.PublicKey) string {
+	a, b := safetyDigits(nickA, keyA), safetyDigits(nickB, keyB)
+	if a > b {
+		a, b = b, a
+	}
+	return a + " " + b
+}
+
+// SafetyNumberQR - A safety number in QR alphanumeric mode characters, for scanning instead of reading out
+func SafetyNumberQR(safetyNumber string) string {
+	return "HUSHCOM:SN:" + strings.Replace(safetyNumber, " ", "", -1)
+}
+
+// SignMsg - Sign a message with the sender's private signing key
+func SignMsg(key ed25519.PrivateKey, msg Msg) ([]byte, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, errors.New("Invalid signing key in SignMsg")
+	}
+	return ed25519.Sign(key, msg.SignMe()), nil
+}
+
+// VerifyMsg - Verify a message signature against the sender's public signing key
+func VerifyMsg(key ed25519.PublicKey, msg Msg) bool {
+	if len(key) != ed25519.PublicKeySize {
 		return false
 	}
-	return (bytes.Equal(sig, msg.Sig))
+	return ed25519.Verify(key, msg.SignMe(), msg.Sig)
 }
@@ -0,0 +1,43 @@
+package hushcom
+
+import (
+	"crypto/ed25519"
+	"strings"
+	"testing"
+)
+
+func TestSafetyNumber(t *testing.T) {
+	keyA, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyB, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ab := SafetyNumber("alice", keyA, "bob", keyB)
+	if ba := SafetyNumber("bob", keyB, "alice", keyA); ab != ba {
+		t.Fatalf("not symmetric: %q and %q", ab, ba)
+	}
+	if again := SafetyNumber("alice", keyA, "bob", keyB); again != ab {
+		t.Fatalf("not stable: %q and %q", ab, again)
+	}
+	if digits := strings.Replace(ab, " ", "", -1); strings.Trim(digits, "0123456789") != "" {
+		t.Fatalf("%q is not all digits", ab)
+	}
+
+	keyC, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if SafetyNumber("alice", keyA, "bob", keyC) == ab {
+		t.Error("same safety number after bob's key changed")
+	}
+	if SafetyNumber("alice", keyA, "carol", keyB) == ab {
+		t.Error("same safety number for a different nick")
+	}
+	if qr := SafetyNumberQR(ab); strings.Contains(qr, " ") || !strings.HasSuffix(qr, strings.Replace(ab, " ", "", -1)) {
+		t.Errorf("SafetyNumberQR(%q) = %q", ab, qr)
+	}
+}
@@ -0,0 +1,71 @@
+package hushcom
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// scrypt parameters for channel password hashes
+const (
+	pwSaltLen = 16
+	pwKeyLen  = 32
+	pwN       = 32768
+	pwR       = 8
+	pwP       = 1
+)
+
+// HashPassword - Salted scrypt hash of a password, encoded as "b64salt$b64hash"
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, pwSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	hash, err := scrypt.Key([]byte(password), salt, pwN, pwR, pwP, pwKeyLen)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(salt) + "$" + base64.StdEncoding.EncodeToString(hash), nil
+}
+
+// CheckPassword - Check a password against a hash from HashPassword
+func CheckPassword(hashed string, password string) bool {
+	salt, hash, err := splitPasswordHash(hashed)
+	if err != nil {
+		return false
+	}
+	check, err := scrypt.Key([]byte(password), salt, pwN, pwR, pwP, pwKeyLen)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(hash, check) == 1
+}
+
+// ValidPasswordHash - Returns true if s looks like a hash from HashPassword
+func ValidPasswordHash(s string) bool {
+	_, _, err := splitPasswordHash(s)
+	return err == nil
+}
+
+func splitPasswordHash(s string) ([]byte, []byte, error) {
+	parts := strings.SplitN(s, "$", 2)
+	if len(parts) != 2 {
+		return nil, nil, errors.New("Malformed password hash")
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	hash, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(salt) != pwSaltLen || len(hash) != pwKeyLen {
+		return nil, nil, errors.New("Malformed password hash")
+	}
+	return salt, hash, nil
+}
@@ -0,0 +1,58 @@
+package hushcom
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPasswordHash(t *testing.T) {
+	hashed, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ValidPasswordHash(hashed) {
+		t.Errorf("ValidPasswordHash(%q) is false", hashed)
+	}
+	if !CheckPassword(hashed, "correct horse") {
+		t.Error("right password did not check")
+	}
+	for _, pw := range []string{"", "correct horse ", "Correct horse", "battery staple"} {
+		if CheckPassword(hashed, pw) {
+			t.Errorf("wrong password %q checked", pw)
+		}
+	}
+
+	again, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == hashed {
+		t.Error("two hashes of one password are the same, salt is not random")
+	}
+	if !CheckPassword(again, "correct horse") {
+		t.Error("right password did not check against the second hash")
+	}
+}
+
+func TestPasswordHashMalformed(t *testing.T) {
+	hashed, err := HashPassword("pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := hashed[:strings.Index(hashed, "$")]
+	for _, bad := range []string{
+		"",
+		"pw",
+		hashed[:len(hashed)-4],
+		"!!!!" + hashed,
+		salt + "$",
+		salt + "$" + salt,
+	} {
+		if ValidPasswordHash(bad) {
+			t.Errorf("ValidPasswordHash(%q) is true", bad)
+		}
+		if CheckPassword(bad, "pw") {
+			t.Errorf("password checked against %q", bad)
+		}
+	}
+}
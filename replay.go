@@ -0,0 +1,156 @@
+package hushcom
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// DefaultMaxSkew - Default allowed difference between a message timestamp and local time
+	DefaultMaxSkew = 5 * time.Minute
+	// DefaultReplayCacheSize - Default number of recent messages remembered per sender
+	DefaultReplayCacheSize = 64
+	// DefaultReplayCacheSenders - Default number of senders tracked before expired ones are swept
+	DefaultReplayCacheSenders = 4096
+)
+
+// StaleMsgError - Message timestamp is outside the allowed clock-skew window
+type StaleMsgError struct {
+	From      string
+	MsgType   string
+	Timestamp int64
+	Skew      time.Duration
+}
+
+func (e *StaleMsgError) Error() string {
+	return "Stale " + e.MsgType + " message from " + e.From + ": timestamp off by " + e.Skew.String()
+}
+
+// DuplicateMsgError - Message has already been seen (replay)
+type DuplicateMsgError struct {
+	From      string
+	MsgType   string
+	Timestamp int64
+}
+
+func (e *DuplicateMsgError) Error() string {
+	return "Duplicate " + e.MsgType + " message from " + e.From + " at " + strconv.FormatInt(e.Timestamp, 10)
+}
+
+type seenMsg struct {
+	timestamp int64
+	sig       []byte
+}
+
+// seenSender - recent messages from one sender, and the newest timestamp of any message
+// forgotten to make room. Anything at or before floor can't be told apart from a replay.
+type seenSender struct {
+	entries []seenMsg
+	floor   int64
+}
+
+// ReplayCache - Rejects stale messages and remembers recent ones per sender to drop duplicates
+type ReplayCache struct {
+	MaxSkew    time.Duration // zero disables the freshness check
+	PerSender  int           // number of recent messages remembered per sender
+	MaxSenders int           // number of senders tracked before expired ones are swept
+
+	mutex sync.Mutex
+	seen  map[string]*seenSender
+	floor int64 // as seenSender.floor, for senders that aren't tracked
+}
+
+// NewReplayCache : Make a new ReplayCache with the given skew window and per-sender size
+func NewReplayCache(maxSkew time.Duration, perSender int) *ReplayCache {
+	rc := new(ReplayCache)
+	rc.MaxSkew = maxSkew
+	rc.PerSender = perSender
+	rc.MaxSenders = DefaultReplayCacheSenders
+	rc.seen = make(map[string]*seenSender)
+	return rc
+}
+
+// Check - Returns a StaleMsgError or DuplicateMsgError if msg should be dropped, otherwise remembers it
+func (rc *ReplayCache) Check(msg Msg) error {
+	now := time.Now().UTC().UnixNano()
+	if rc.MaxSkew > 0 {
+		skew := time.Duration(now - msg.Timestamp)
+		if skew < 0 {
+			skew = -skew
+		}
+		if skew > rc.MaxSkew {
+			return &StaleMsgError{From: msg.From, MsgType: msg.MsgType, Timestamp: msg.Timestamp, Skew: skew}
+		}
+	}
+
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	sender, ok := rc.seen[msg.From]
+	if !ok && len(rc.seen) >= rc.MaxSenders {
+		rc.sweep(now)
+	}
+	if !ok {
+		sender = &seenSender{floor: rc.floor}
+	}
+	if msg.Timestamp <= sender.floor {
+		return &DuplicateMsgError{From: msg.From, MsgType: msg.MsgType, Timestamp: msg.Timestamp}
+	}
+	for _, entry := range sender.entries {
+		if entry.timestamp == msg.Timestamp && bytes.Equal(entry.sig, msg.Sig) {
+			return &DuplicateMsgError{From: msg.From, MsgType: msg.MsgType, Timestamp: msg.Timestamp}
+		}
+	}
+	sender.entries = append(sender.entries, seenMsg{timestamp: msg.Timestamp, sig: msg.Sig})
+	if rc.PerSender > 0 && len(sender.entries) > rc.PerSender {
+		// forget the oldest, and anything before it from now on
+		oldest := 0
+		for i, entry := range sender.entries {
+			if entry.timestamp < sender.entries[oldest].timestamp {
+				oldest = i
+			}
+		}
+		sender.floor = sender.entries[oldest].timestamp
+		sender.entries = append(sender.entries[:oldest], sender.entries[oldest+1:]...)
+	}
+	rc.seen[msg.From] = sender
+	return nil
+}
+
+// newest - timestamp of the newest message remembered from sender
+func (sender *seenSender) newest() int64 {
+	newest := sender.floor
+	for _, entry := range sender.entries {
+		if entry.timestamp > newest {
+			newest = entry.timestamp
+		}
+	}
+	return newest
+}
+
+// sweep - drop senders whose newest message is already outside the skew window. If none
+// have expired, drop the one heard from longest ago, and refuse anything from a sender
+// that isn't tracked at or before its newest message.
+func (rc *ReplayCache) sweep(now int64) {
+	for from, sender := range rc.seen {
+		if rc.MaxSkew > 0 && time.Duration(now-sender.newest()) > rc.MaxSkew {
+			delete(rc.seen, from)
+		}
+	}
+	if len(rc.seen) > 0 && len(rc.seen) >= rc.MaxSenders {
+		var oldest string
+		var oldestNewest int64
+		found := false
+		for from, sender := range rc.seen {
+			if newest := sender.newest(); !found || newest < oldestNewest {
+				oldest, oldestNewest, found = from, newest, true
+			}
+		}
+		if oldestNewest > rc.floor {
+			rc.floor = oldestNewest
+		}
+		delete(rc.seen, oldest)
+	}
+}
@@ -0,0 +1,124 @@
+package hushcom
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReplayCacheDuplicate(t *testing.T) {
+	rc := NewReplayCache(time.Minute, 8)
+	now := time.Now().UTC().UnixNano()
+	msg := Msg{From: "alice", MsgType: "PrivMsg", Timestamp: now, Sig: []byte{1}}
+	if err := rc.Check(msg); err != nil {
+		t.Fatal(err)
+	}
+	var dup *DuplicateMsgError
+	if err := rc.Check(msg); !errors.As(err, &dup) {
+		t.Fatalf("replayed message: got %v, want a DuplicateMsgError", err)
+	}
+	// same timestamp, different signature is a different message
+	msg.Sig = []byte{2}
+	if err := rc.Check(msg); err != nil {
+		t.Fatal(err)
+	}
+	// and so is the same message from someone else
+	msg.From = "bob"
+	if err := rc.Check(msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplayCacheStale(t *testing.T) {
+	rc := NewReplayCache(time.Minute, 8)
+	now := time.Now().UTC()
+	var stale *StaleMsgError
+	for _, ts := range []time.Time{now.Add(-2 * time.Minute), now.Add(2 * time.Minute)} {
+		msg := Msg{From: "alice", MsgType: "PrivMsg", Timestamp: ts.UnixNano(), Sig: []byte{1}}
+		if err := rc.Check(msg); !errors.As(err, &stale) {
+			t.Fatalf("timestamp %v from %v: got %v, want a StaleMsgError", ts, now, err)
+		}
+	}
+	msg := Msg{From: "alice", MsgType: "PrivMsg", Timestamp: now.Add(-30 * time.Second).UnixNano(), Sig: []byte{1}}
+	if err := rc.Check(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	// zero MaxSkew doesn't check timestamps
+	rc = NewReplayCache(0, 8)
+	msg.Timestamp = 1
+	if err := rc.Check(msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplayCacheEviction(t *testing.T) {
+	rc := NewReplayCache(time.Minute, 2)
+	now := time.Now().UTC().UnixNano()
+	msgs := make([]Msg, 3)
+	for i := range msgs {
+		msgs[i] = Msg{From: "alice", MsgType: "PrivMsg", Timestamp: now + int64(i), Sig: []byte{byte(i)}}
+		if err := rc.Check(msgs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rc.Check(msgs[2]); err == nil {
+		t.Error("newest message was not remembered")
+	}
+	// forgotten to make room, but still inside the window
+	var dup *DuplicateMsgError
+	if err := rc.Check(msgs[0]); !errors.As(err, &dup) {
+		t.Errorf("replayed an evicted message: got %v, want a DuplicateMsgError", err)
+	}
+	// and so is anything older, even never seen
+	older := Msg{From: "alice", MsgType: "PrivMsg", Timestamp: now - 1, Sig: []byte{9}}
+	if err := rc.Check(older); !errors.As(err, &dup) {
+		t.Errorf("message from before an evicted one: got %v, want a DuplicateMsgError", err)
+	}
+	// newer ones still go through, out of order too
+	for _, ts := range []int64{now + 10, now + 5} {
+		msg := Msg{From: "alice", MsgType: "PrivMsg", Timestamp: ts, Sig: []byte{9}}
+		if err := rc.Check(msg); err != nil {
+			t.Errorf("timestamp %d: %v", ts-now, err)
+		}
+	}
+}
+
+func TestReplayCacheSweep(t *testing.T) {
+	rc := NewReplayCache(time.Minute, 8)
+	rc.MaxSenders = 2
+	now := time.Now().UTC()
+	old := Msg{From: "alice", MsgType: "PrivMsg", Timestamp: now.Add(-50 * time.Second).UnixNano(), Sig: []byte{1}}
+	recent := Msg{From: "bob", MsgType: "PrivMsg", Timestamp: now.UnixNano(), Sig: []byte{1}}
+	if err := rc.Check(old); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.Check(recent); err != nil {
+		t.Fatal(err)
+	}
+
+	// alice's newest message is out of the window by now, bob's isn't
+	rc.sweep(now.Add(30 * time.Second).UnixNano())
+	if _, ok := rc.seen["alice"]; ok {
+		t.Error("expired sender was not swept")
+	}
+	if _, ok := rc.seen["bob"]; !ok {
+		t.Error("current sender was swept")
+	}
+
+	// with nobody expired, a new sender still fits
+	for i, from := range []string{"carol", "dave", "eve"} {
+		msg := Msg{From: from, MsgType: "PrivMsg", Timestamp: now.UnixNano() + int64(i+1), Sig: []byte{1}}
+		if err := rc.Check(msg); err != nil {
+			t.Fatal(err)
+		}
+		if len(rc.seen) > rc.MaxSenders {
+			t.Fatalf("tracking %d senders, MaxSenders is %d", len(rc.seen), rc.MaxSenders)
+		}
+	}
+	// bob was dropped while his message is still inside the window, it can't come back
+	var dup *DuplicateMsgError
+	if err := rc.Check(recent); !errors.As(err, &dup) {
+		t.Errorf("replayed a message from an evicted sender: got %v, want a DuplicateMsgError", err)
+	}
+}
@@ -0,0 +1,245 @@
+package server
+
+import (
+	"database/sql"
+
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/hushcom"
+)
+
+// Store - Persistence layer behind a Hushcom Server
+type Store interface {
+	// Load : read all users and channels into the given maps
+	Load(chans map[string]*HCSrvChan, users map[string]*HCSrvUser) error
+	// SaveUser : add or update a registered user
+	SaveUser(name string, user *HCSrvUser) error
+	// DeleteUser : remove a registered user
+	DeleteUser(name string) error
+	// SaveChan : add or update a channel, including its admins, members, bans and kicks
+	SaveChan(name string, channel *HCSrvChan) error
+	// DeleteChan : remove a channel, including its admins, members, bans and kicks
+	DeleteChan(name string) error
+}
+
+// QLStore - Store implementation using hushcom-owned tables in the ratnet QL database
+type QLStore struct {
+	db func() *sql.DB
+}
+
+// NewQLStore : Make a new Store backed by a ratnet QL database
+func NewQLStore(db func() *sql.DB) *QLStore {
+	store := new(QLStore)
+	store.db = db
+	return store
+}
+
+func (s *QLStore) transactExec(stmts ...func(tx *sql.Tx) error) error {
+	c := s.db()
+	defer c.Close()
+	tx, err := c.Begin()
+	if err != nil {
+		return err
+	}
+	for _, stmt := range stmts {
+		if err := stmt(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func exec(sqlq string, params ...interface{}) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(sqlq, params...)
+		return err
+	}
+}
+
+func (s *QLStore) bootstrap() error {
+	return s.transactExec(
+		exec(`
+		CREATE TABLE IF NOT EXISTS hc_users (
+			name	string	NOT NULL,
+			pubkey	string	NOT NULL,
+			sigkey	string	NOT NULL
+		);`),
+		exec(`
+		CREATE TABLE IF NOT EXISTS hc_chans (
+			name		string	NOT NULL,
+			pubkey		string	NOT NULL,
+			sigkey		string	NOT NULL,
+			password	string	NOT NULL,
+			private		bool	NOT NULL,
+			owner		string	NOT NULL
+		);`),
+		exec(`
+		CREATE TABLE IF NOT EXISTS hc_chan_admins (
+			channel	string	NOT NULL,
+			name	string	NOT NULL
+		);`),
+		exec(`
+		CREATE TABLE IF NOT EXISTS hc_chan_users (
+			channel	string	NOT NULL,
+			name	string	NOT NULL
+		);`),
+		exec(`
+		CREATE TABLE IF NOT EXISTS hc_chan_bans (
+			channel	string	NOT NULL,
+			name	string	NOT NULL
+		);`),
+		exec(`
+		CREATE TABLE IF NOT EXISTS hc_chan_kicks (
+			channel	string	NOT NULL,
+			name	string	NOT NULL
+		);`),
+	)
+}
+
+// Load : read all users and channels into the given maps, creating tables if needed
+func (s *QLStore) Load(chans map[string]*HCSrvChan, users map[string]*HCSrvUser) error {
+	if err := s.bootstrap(); err != nil {
+		return err
+	}
+	c := s.db()
+	defer c.Close()
+
+	// Users
+	r, err := c.Query("SELECT name,pubkey,sigkey FROM hc_users;")
+	if err != nil {
+		return err
+	}
+	for r.Next() {
+		var name, pubkey, sigkey string
+		if err := r.Scan(&name, &pubkey, &sigkey); err != nil {
+			r.Close()
+			return err
+		}
+		k := new(ecc.PubKey)
+		if err := k.FromB64(pubkey); err != nil {
+			r.Close()
+			return err
+		}
+		sk, err := hushcom.SigKeyFromB64(sigkey)
+		if err != nil {
+			r.Close()
+			return err
+		}
+		users[name] = &HCSrvUser{Key: k, SigKey: sk}
+	}
+	r.Close()
+
+	// Channels
+	r, err = c.Query("SELECT name,pubkey,sigkey,password,private,owner FROM hc_chans;")
+	if err != nil {
+		return err
+	}
+	for r.Next() {
+		var name, pubkey, sigkey, password, owner string
+		var private bool
+		if err := r.Scan(&name, &pubkey, &sigkey, &password, &private, &owner); err != nil {
+			r.Close()
+			return err
+		}
+		k := new(ecc.PubKey)
+		if err := k.FromB64(pubkey); err != nil {
+			r.Close()
+			return err
+		}
+		sk, err := hushcom.SigKeyFromB64(sigkey)
+		if err != nil {
+			r.Close()
+			return err
+		}
+		chans[name] = &HCSrvChan{Key: k, SigKey: sk, Password: password, Private: private, Owner: owner}
+	}
+	r.Close()
+
+	// Channel Admins, Members, Bans and Kicks
+	if err := loadChanList(c, "SELECT channel,name FROM hc_chan_admins;", chans,
+		func(ch *HCSrvChan) *[]string { return &ch.Admins }); err != nil {
+		return err
+	}
+	if err := loadChanList(c, "SELECT channel,name FROM hc_chan_users;", chans,
+		func(ch *HCSrvChan) *[]string { return &ch.Users }); err != nil {
+		return err
+	}
+	if err := loadChanList(c, "SELECT channel,name FROM hc_chan_bans;", chans,
+		func(ch *HCSrvChan) *[]string { return &ch.Bans }); err != nil {
+		return err
+	}
+	return loadChanList(c, "SELECT channel,name FROM hc_chan_kicks;", chans,
+		func(ch *HCSrvChan) *[]string { return &ch.Kicked })
+}
+
+func loadChanList(c *sql.DB, sqlq string, chans map[string]*HCSrvChan,
+	list func(*HCSrvChan) *[]string) error {
+
+	r, err := c.Query(sqlq)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for r.Next() {
+		var channel, name string
+		if err := r.Scan(&channel, &name); err != nil {
+			return err
+		}
+		if ch, ok := chans[channel]; ok {
+			l := list(ch)
+			*l = append(*l, name)
+		}
+	}
+	return r.Err()
+}
+
+// SaveUser : add or update a registered user
+func (s *QLStore) SaveUser(name string, user *HCSrvUser) error {
+	return s.transactExec(
+		exec("DELETE FROM hc_users WHERE name==$1;", name),
+		exec("INSERT INTO hc_users VALUES( $1, $2, $3 );",
+			name, user.Key.ToB64(), hushcom.SigKeyToB64(user.SigKey)),
+	)
+}
+
+// DeleteUser : remove a registered user
+func (s *QLStore) DeleteUser(name string) error {
+	return s.transactExec(exec("DELETE FROM hc_users WHERE name==$1;", name))
+}
+
+// SaveChan : add or update a channel, including its admins, members, bans and kicks
+func (s *QLStore) SaveChan(name string, channel *HCSrvChan) error {
+	stmts := []func(tx *sql.Tx) error{
+		exec("DELETE FROM hc_chans WHERE name==$1;", name),
+		exec("DELETE FROM hc_chan_admins WHERE channel==$1;", name),
+		exec("DELETE FROM hc_chan_users WHERE channel==$1;", name),
+		exec("DELETE FROM hc_chan_bans WHERE channel==$1;", name),
+		exec("DELETE FROM hc_chan_kicks WHERE channel==$1;", name),
+		exec("INSERT INTO hc_chans VALUES( $1, $2, $3, $4, $5, $6 );",
+			name, channel.Key.ToB64(), hushcom.SigKeyToB64(channel.SigKey), channel.Password, channel.Private, channel.Owner),
+	}
+	for _, admin := range channel.Admins {
+		stmts = append(stmts, exec("INSERT INTO hc_chan_admins VALUES( $1, $2 );", name, admin))
+	}
+	for _, user := range channel.Users {
+		stmts = append(stmts, exec("INSERT INTO hc_chan_users VALUES( $1, $2 );", name, user))
+	}
+	for _, ban := range channel.Bans {
+		stmts = append(stmts, exec("INSERT INTO hc_chan_bans VALUES( $1, $2 );", name, ban))
+	}
+	for _, kick := range channel.Kicked {
+		stmts = append(stmts, exec("INSERT INTO hc_chan_kicks VALUES( $1, $2 );", name, kick))
+	}
+	return s.transactExec(stmts...)
+}
+
+// DeleteChan : remove a channel, including its admins, members, bans and kicks
+func (s *QLStore) DeleteChan(name string) error {
+	return s.transactExec(
+		exec("DELETE FROM hc_chans WHERE name==$1;", name),
+		exec("DELETE FROM hc_chan_admins WHERE channel==$1;", name),
+		exec("DELETE FROM hc_chan_users WHERE channel==$1;", name),
+		exec("DELETE FROM hc_chan_bans WHERE channel==$1;", name),
+		exec("DELETE FROM hc_chan_kicks WHERE channel==$1;", name),
+	)
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/awgh/hushcom"
+	"github.com/awgh/ratnet/api"
+)
+
+// DefaultMaxMsgSize - Largest encoded message the server will decode, in bytes
+const DefaultMaxMsgSize = 64 * 1024
+
+// maxNameLen - longest sender nick or message type accepted
+const maxNameLen = 256
+
+// ProtocolError - Why a message was rejected
+type ProtocolError struct {
+	Code          string // one of the hushcom.ErrCode constants
+	From          string // sender, as claimed by the message
+	MsgType       string
+	RequestID     string // of the rejected message, echoed in the ErrorResp
+	CorrelationID string // of the rejected message, see hushcom.Msg.CorrelationID
+	Authenticated bool   // the sender's signature checked out
+	Err           error
+
+	quiet bool // counted, but the sender isn't told
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Code + " " + e.MsgType + " message from " + e.From + ": " + e.Err.Error()
+}
+
+// Unwrap - The underlying error
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+func protocolError(code string, err error) *ProtocolError {
+	return &ProtocolError{Code: code, Err: err}
+}
+
+// malformed - a message that could not be decoded
+func malformed(text string) error {
+	return protocolError(hushcom.ErrCodeMalformed, errors.New(text))
+}
+
+// refused - a well formed message the sender isn't allowed to send, or that can't be done
+func refused(text string) error {
+	return protocolError(hushcom.ErrCodeRefused, errors.New(text))
+}
+
+// decodeMsg - read the hushcom message out of a ratnet message, within the size limits
+func (modInst *Server) decodeMsg(msg api.Msg) (metaData hushcom.Msg, err error) {
+	if msg.Content == nil {
+		return metaData, malformed("Empty message")
+	}
+	maxSize := modInst.MaxMsgSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxMsgSize
+	}
+	if msg.Content.Len() > maxSize {
+		return metaData, protocolError(hushcom.ErrCodeTooLarge,
+			fmt.Errorf("%d bytes, limit is %d", msg.Content.Len(), maxSize))
+	}
+	// the decoder shouldn't panic on bad input, but one bad packet must not take the server down
+	defer func() {
+		if r := recover(); r != nil {
+			err = malformed(fmt.Sprint("gob decode panic: ", r))
+		}
+	}()
+	// Create a decoder and receive a value.
+	dec := gob.NewDecoder(bytes.NewReader(msg.Content.Bytes()))
+	if err := dec.Decode(&metaData); err != nil {
+		return metaData, malformed("gob decode: " + err.Error())
+	}
+	if metaData.From == "" || len(metaData.From) > maxNameLen || len(metaData.MsgType) > maxNameLen {
+		return metaData, malformed("Bad sender or message type")
+	}
+	return metaData, nil
+}
+
+// reject - classify and count a failed message, and tell the sender if they can be identified
+func (modInst *Server) reject(metaData hushcom.Msg, err error) error {
+	if err == nil {
+		return nil
+	}
+	var perr *ProtocolError
+	if !errors.As(err, &perr) {
+		perr = protocolError(hushcom.ErrCodeInternal, err)
+	}
+	perr.From = metaData.From
+	perr.MsgType = metaData.MsgType
+	perr.RequestID = metaData.RequestID
+	perr.CorrelationID = metaData.CorrelationID()
+
+	modInst.rejectedMutex.Lock()
+	modInst.rejected[perr.Code]++
+	modInst.rejectedMutex.Unlock()
+
+	if modInst.ErrorReplies && !perr.quiet {
+		if modInst.canReply(perr) {
+			if rerr := modInst.sendErrorResp(perr); rerr != nil {
+				log.Println("Could not send ErrorResp to " + perr.From + ": " + rerr.Error())
+			}
+		} else {
+			log.Println("Dropped " + perr.Error())
+		}
+	}
+	return perr
+}
+
+// canReply - ErrorResps only answer messages whose signature checked out, encrypted to the
+// sender's key on file. Anyone can put a nick on a message, and the replies would go to its owner.
+func (modInst *Server) canReply(perr *ProtocolError) bool {
+	return perr.Authenticated
+}
+
+// sendErrorResp - tell the sender why their message was rejected
+func (modInst *Server) sendErrorResp(perr *ProtocolError) error {
+	var resp hushcom.ErrorRespMsg
+	resp.Code = perr.Code
+	resp.MsgType = perr.MsgType
+	resp.CorrelationID = perr.CorrelationID
+	resp.Error = perr.Err.Error()
+	if perr.Code == hushcom.ErrCodeInternal {
+		resp.Error = "Internal server error" // details stay in the server log
+	}
+	var msg hushcom.Msg
+	msg.From = modInst.GetName()
+	msg.MsgType = "ErrorResp"
+	msg.Timestamp = time.Now().UTC().UnixNano()
+	msg.RequestID = perr.RequestID
+	jsonb, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	msg.Data = jsonb
+	return modInst.sendToClient(msg, perr.From)
+}
+
+// Rejected - Number of messages rejected since startup, by hushcom.ErrCode
+func (modInst *Server) Rejected() map[string]uint64 {
+	modInst.rejectedMutex.Lock()
+	defer modInst.rejectedMutex.Unlock()
+	counts := make(map[string]uint64, len(modInst.rejected))
+	for code, n := range modInst.rejected {
+		counts[code] = n
+	}
+	return counts
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefaultMaxChansPerUser - Channels one user may own, unless told otherwise
+const DefaultMaxChansPerUser = 32
+
+// maxSenders - senders with token buckets kept before idle ones are swept
+const maxSenders = 16384
+
+// ErrThrottled - The sender, or the server as a whole, is over its rate limit, the message was dropped
+var ErrThrottled = errors.New("Rate limit exceeded, message dropped")
+
+// Limit - A token bucket: Burst messages at once, refilled at Rate messages per second.
+// A zero Rate means no limit.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// PerMinute : Limit of n messages a minute, in bursts of up to burst
+func PerMinute(n float64, burst int) Limit {
+	return Limit{Rate: n / 60, Burst: burst}
+}
+
+// Limits - Rate limits and caps the server applies, see Server.Limits
+type Limits struct {
+	Global          Limit            // all messages from everyone, checked before authentication
+	PerNick         Limit            // all messages from one sender
+	PerType         map[string]Limit // messages of one type from one sender, by MsgType
+	MaxChansPerUser int              // channels one user may own, no cap if zero
+}
+
+// DefaultLimits : Limits that leave a well-behaved client alone
+func DefaultLimits() Limits {
+	return Limits{
+		Global:  Limit{Rate: 1000, Burst: 2000},
+		PerNick: Limit{Rate: 10, Burst: 50},
+		PerType: map[string]Limit{
+			"Register":  PerMinute(2, 5),
+			"NewChan":   PerMinute(6, 10),
+			"ListChans": PerMinute(12, 10),
+			"Whois":     PerMinute(120, 60),
+		},
+		MaxChansPerUser: DefaultMaxChansPerUser,
+	}
+}
+
+// bucket - tokens left, as of last
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(l Limit, now time.Time) *bucket {
+	return &bucket{tokens: float64(l.Burst), last: now}
+}
+
+// full - top the bucket up for the time since it was last used, true if it's full
+func (b *bucket) full(l Limit, now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * l.Rate
+	if b.tokens >= float64(l.Burst) {
+		b.tokens = float64(l.Burst)
+	}
+	b.last = now
+	return b.tokens >= float64(l.Burst)
+}
+
+// ready - there's a token to take
+func (b *bucket) ready(l Limit, now time.Time) bool {
+	if l.Rate == 0 {
+		return true
+	}
+	b.full(l, now)
+	return b.tokens >= 1
+}
+
+// take - one token, if there is one
+func (b *bucket) take(l Limit, now time.Time) bool {
+	if !b.ready(l, now) {
+		return false
+	}
+	if l.Rate != 0 {
+		b.tokens--
+	}
+	return true
+}
+
+// sender - one nick's token buckets
+type sender struct {
+	bucket
+	types   map[string]*bucket // by MsgType
+	noticed bool               // told it's throttled, reset once a message gets through
+}
+
+// limiter - the server's token buckets
+type limiter struct {
+	mutex   sync.Mutex
+	global  *bucket
+	senders map[string]*sender
+}
+
+func newLimiter() *limiter {
+	lim := new(limiter)
+	lim.senders = make(map[string]*sender)
+	return lim
+}
+
+// allowGlobal - take a token from the server-wide bucket
+func (lim *limiter) allowGlobal(limits *Limits, now time.Time) bool {
+	lim.mutex.Lock()
+	defer lim.mutex.Unlock()
+	if lim.global == nil {
+		lim.global = newBucket(limits.Global, now)
+	}
+	return lim.global.take(limits.Global, now)
+}
+
+// allow - take a token from the nick's bucket and its bucket for msgType.
+// When it's throttled, notice is true the first time, until a message gets through again.
+func (lim *limiter) allow(limits *Limits, nick, msgType string, now time.Time) (ok bool, notice bool) {
+	typeLimit := limits.PerType[msgType]
+	if limits.PerNick.Rate == 0 && typeLimit.Rate == 0 {
+		return true, false
+	}
+	lim.mutex.Lock()
+	defer lim.mutex.Unlock()
+	s, found := lim.senders[nick]
+	if !found {
+		if len(lim.senders) >= maxSenders {
+			lim.sweep(limits, now)
+		}
+		s = &sender{bucket: *newBucket(limits.PerNick, now), types: make(map[string]*bucket)}
+		lim.senders[nick] = s
+	}
+	t, found := s.types[msgType]
+	if !found && typeLimit.Rate != 0 {
+		t = newBucket(typeLimit, now)
+		s.types[msgType] = t
+	}
+	// check both before taking from either, a dropped message costs nothing
+	if s.ready(limits.PerNick, now) && (t == nil || t.ready(typeLimit, now)) {
+		s.take(limits.PerNick, now)
+		if t != nil {
+			t.take(typeLimit, now)
+		}
+		s.noticed = false
+		return true, false
+	}
+	notice = !s.noticed
+	s.noticed = true
+	return false, notice
+}
+
+// sweep - forget senders whose buckets have all refilled, they'd be made full again anyway
+func (lim *limiter) sweep(limits *Limits, now time.Time) {
+	for nick, s := range lim.senders {
+		idle := limits.PerNick.Rate == 0 || s.bucket.full(limits.PerNick, now)
+		for msgType, t := range s.types {
+			if !t.full(limits.PerType[msgType], now) {
+				idle = false
+			}
+		}
+		if idle {
+			delete(lim.senders, nick)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketBurst(t *testing.T) {
+	l := Limit{Rate: 1, Burst: 3}
+	now := time.Now()
+	b := newBucket(l, now)
+	for i := 0; i < 3; i++ {
+		if !b.take(l, now) {
+			t.Fatalf("take %d of a full bucket of 3 failed", i+1)
+		}
+	}
+	if b.take(l, now) {
+		t.Fatal("took a 4th token from a bucket of 3 with no time passed")
+	}
+}
+
+func TestBucketRefill(t *testing.T) {
+	l := Limit{Rate: 2, Burst: 4}
+	now := time.Now()
+	b := newBucket(l, now)
+	for b.take(l, now) {
+	}
+	// half a second at 2 a second is one token
+	now = now.Add(500 * time.Millisecond)
+	if !b.take(l, now) {
+		t.Fatal("no token after refilling for one")
+	}
+	if b.take(l, now) {
+		t.Fatal("second token after refilling for one")
+	}
+	// a long wait fills it only up to the burst
+	now = now.Add(time.Hour)
+	n := 0
+	for b.take(l, now) {
+		n++
+	}
+	if n != l.Burst {
+		t.Fatalf("took %d tokens after a long wait, want the burst of %d", n, l.Burst)
+	}
+}
+
+func TestBucketUnlimited(t *testing.T) {
+	var l Limit
+	now := time.Now()
+	b := newBucket(l, now)
+	for i := 0; i < 1000; i++ {
+		if !b.take(l, now) {
+			t.Fatal("zero Rate limited a take")
+		}
+	}
+}
+
+func TestLimiterPerType(t *testing.T) {
+	limits := Limits{
+		PerNick: Limit{Rate: 1, Burst: 10},
+		PerType: map[string]Limit{"NewChan": {Rate: 1, Burst: 1}},
+	}
+	lim := newLimiter()
+	now := time.Now()
+	if ok, _ := lim.allow(&limits, "alice", "NewChan", now); !ok {
+		t.Fatal("first NewChan was throttled")
+	}
+	ok, notice := lim.allow(&limits, "alice", "NewChan", now)
+	if ok || !notice {
+		t.Fatalf("second NewChan: ok %v notice %v, want throttled with a notice", ok, notice)
+	}
+	if ok, notice := lim.allow(&limits, "alice", "NewChan", now); ok || notice {
+		t.Fatalf("third NewChan: ok %v notice %v, want throttled without a notice", ok, notice)
+	}
+	// other types still go through, and the throttled ones didn't use up the nick's tokens
+	for i := 0; i < 9; i++ {
+		if ok, _ := lim.allow(&limits, "alice", "Whois", now); !ok {
+			t.Fatalf("Whois %d was throttled", i+1)
+		}
+	}
+	if ok, _ := lim.allow(&limits, "bob", "NewChan", now); !ok {
+		t.Fatal("another nick's NewChan was throttled")
+	}
+	now = now.Add(time.Second)
+	if ok, _ := lim.allow(&limits, "alice", "NewChan", now); !ok {
+		t.Fatal("NewChan still throttled after refilling")
+	}
+}
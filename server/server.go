@@ -2,11 +2,16 @@ package server
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"database/sql"
 	"encoding/gob"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"log"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/awgh/bencrypt/bc"
@@ -20,10 +25,10 @@ func rmFrmList(list *[]string, item string) {
 	var newList []string
 	for _, listItem := range *list {
 		if listItem != item {
-			newList = append(newList, item)
+			newList = append(newList, listItem)
 		}
 	}
-	list = &newList
+	*list = newList
 }
 
 // Scan list for item
@@ -36,107 +41,455 @@ func chkList(list *[]string, item string) bool {
 	return false
 }
 
-// HCSrvChan - Server data record
+// HCSrvChan - Server data record. Hold mutex while reading or changing a channel in the channel map.
 type HCSrvChan struct {
+	mutex sync.Mutex
+
 	Key      bc.PubKey
-	Password string
+	SigKey   ed25519.PublicKey // checks ChanJoined membership proofs
+	Password string            // salted password hash, never plaintext
+	Private  bool              // hidden from ListChans
+	Owner    string            // creator, unless ownership was transferred
 	Admins   []string
 	Users    []string
+	Bans     []string // may not rejoin until unbanned
+	Kicked   []string // may not rejoin until the channel key is rotated, they still hold the old one
+}
+
+// admin - Apply a channel administration action by admin "by" to "nick"
+func (srvChan *HCSrvChan) admin(action, by, nick string) error {
+	if !chkList(&srvChan.Admins, by) {
+		return errors.New(by + " is not a channel admin")
+	}
+	if nick == "" {
+		return errors.New("no user given")
+	}
+	if nick == srvChan.Owner {
+		return errors.New(nick + " is the channel owner")
+	}
+	// as with Deop, only the owner can remove an admin
+	if (action == "Kick" || action == "Ban") && chkList(&srvChan.Admins, nick) && by != srvChan.Owner {
+		return errors.New("only the channel owner can kick or ban an admin")
+	}
+	switch action {
+	case "Kick":
+		if !chkList(&srvChan.Users, nick) && !chkList(&srvChan.Admins, nick) {
+			return errors.New(nick + " is not a member")
+		}
+		rmFrmList(&srvChan.Users, nick)
+		rmFrmList(&srvChan.Admins, nick)
+		if !chkList(&srvChan.Kicked, nick) {
+			srvChan.Kicked = append(srvChan.Kicked, nick)
+		}
+	case "Ban":
+		rmFrmList(&srvChan.Users, nick)
+		rmFrmList(&srvChan.Admins, nick)
+		if !chkList(&srvChan.Bans, nick) {
+			srvChan.Bans = append(srvChan.Bans, nick)
+		}
+	case "Unban":
+		if !chkList(&srvChan.Bans, nick) {
+			return errors.New(nick + " is not banned")
+		}
+		rmFrmList(&srvChan.Bans, nick)
+	case "Op":
+		if !chkList(&srvChan.Users, nick) {
+			return errors.New(nick + " is not a member")
+		}
+		if !chkList(&srvChan.Admins, nick) {
+			srvChan.Admins = append(srvChan.Admins, nick)
+		}
+	case "Deop":
+		// admins can't deop each other, only the owner can
+		if by != srvChan.Owner {
+			return errors.New("only the channel owner can deop")
+		}
+		if !chkList(&srvChan.Admins, nick) {
+			return errors.New(nick + " is not a channel admin")
+		}
+		rmFrmList(&srvChan.Admins, nick)
+	case "TransferOwner":
+		if by != srvChan.Owner {
+			return errors.New("only the channel owner can transfer ownership")
+		}
+		if !chkList(&srvChan.Users, nick) {
+			return errors.New(nick + " is not a member")
+		}
+		if !chkList(&srvChan.Admins, nick) {
+			srvChan.Admins = append(srvChan.Admins, nick)
+		}
+		srvChan.Owner = nick
+	default:
+		return errors.New("unknown channel admin action")
+	}
+	return nil
+}
+
+// part - Remove nick from the channel, handing ownership to an admin (or else a member, made
+// an admin) if nick owned it. False if nick wasn't in the channel.
+func (srvChan *HCSrvChan) part(nick string) bool {
+	if !chkList(&srvChan.Users, nick) && !chkList(&srvChan.Admins, nick) && srvChan.Owner != nick {
+		return false
+	}
+	rmFrmList(&srvChan.Users, nick)
+	rmFrmList(&srvChan.Admins, nick)
+	if srvChan.Owner == nick {
+		srvChan.Owner = ""
+		if len(srvChan.Admins) > 0 {
+			srvChan.Owner = srvChan.Admins[0]
+		} else if len(srvChan.Users) > 0 {
+			srvChan.Owner = srvChan.Users[0]
+			srvChan.Admins = append(srvChan.Admins, srvChan.Owner)
+		}
+	}
+	return true
+}
+
+// empty - True once the last member has left, after part. Hold mutex.
+func (srvChan *HCSrvChan) empty() bool {
+	return srvChan.Owner == "" && len(srvChan.Admins) == 0 && len(srvChan.Users) == 0
+}
+
+// HCSrvUser - Server user record
+type HCSrvUser struct {
+	Key    bc.PubKey         // content pubkey, used to encrypt to this user
+	SigKey ed25519.PublicKey // signing pubkey, used to authenticate this user
 }
 
-// Server - Hushcom Server
+// Server - Hushcom Server, safe for concurrent use. HandleMsg may be called from several
+// goroutines, see Workers for running it in parallel while keeping each sender's messages in order.
 type Server struct {
-	// Globals
+	// Globals, guarded by chansMutex and usersMutex once messages are being handled
 	HCSrvChans map[string]*HCSrvChan
-	HCSrvUsers map[string]bc.PubKey
+	HCSrvUsers map[string]*HCSrvUser
+	chansMutex sync.RWMutex // lock before a channel's own mutex, never the other way around
+	usersMutex sync.RWMutex
 
 	// Settings
-	Node api.Node
+	Node   api.Node
+	DB     func() *sql.DB
+	Store  Store                // optional, server state is memory-only if nil
+	Replay *hushcom.ReplayCache // optional, drops stale and replayed messages
+
+	MaxMsgSize   int    // largest encoded message accepted, DefaultMaxMsgSize if zero
+	ErrorReplies bool   // send an ErrorResp to authenticated senders of rejected messages
+	Limits       Limits // rate limits and caps, set before handling messages
+
+	limiter *limiter
+
+	// public channels for ListChans, nil until the next ListChans after a change.
+	// chanListMutex is never held while taking another lock.
+	chanList      []hushcom.Channel
+	chanListGen   uint64 // bumped on every change
+	chanListMutex sync.Mutex
+
+	rejected      map[string]uint64 // rejected messages, by hushcom.ErrCode
+	rejectedMutex sync.Mutex
+
+	sigKey   ed25519.PrivateKey
+	sigMutex sync.Mutex
 }
 
 // New : Make a new instance of a Hushcom Server
-func New(node api.Node) *Server {
+func New(node api.Node, db func() *sql.DB) *Server {
 	server := new(Server)
 	server.Node = node
+	server.DB = db
+	server.Store = NewQLStore(db)
+	server.Replay = hushcom.NewReplayCache(hushcom.DefaultMaxSkew, hushcom.DefaultReplayCacheSize)
 	server.HCSrvChans = make(map[string]*HCSrvChan)
-	server.HCSrvUsers = make(map[string]bc.PubKey)
+	server.HCSrvUsers = make(map[string]*HCSrvUser)
+	server.MaxMsgSize = DefaultMaxMsgSize
+	server.ErrorReplies = true
+	server.Limits = DefaultLimits()
+	server.limiter = newLimiter()
+	server.rejected = make(map[string]uint64)
 	return server
 }
 
+// Load - Load registered users and channels from the Store, before handling any messages
+func (modInst *Server) Load() error {
+	if modInst.Store == nil {
+		return nil
+	}
+	if err := modInst.Store.Load(modInst.HCSrvChans, modInst.HCSrvUsers); err != nil {
+		return err
+	}
+	modInst.chansChanged()
+	// ratnet needs a contact entry to send to each user
+	for name, user := range modInst.HCSrvUsers {
+		if err := modInst.Node.AddContact(name, user.Key.ToB64()); err != nil {
+			return err
+		}
+	}
+	log.Printf("Loaded %d users and %d channels\n", len(modInst.HCSrvUsers), len(modInst.HCSrvChans))
+	return nil
+}
+
+// SigningKey - Get the server's signing key, derived from the node's content key
+func (modInst *Server) SigningKey() (ed25519.PrivateKey, error) {
+	modInst.sigMutex.Lock()
+	defer modInst.sigMutex.Unlock()
+	if modInst.sigKey != nil {
+		return modInst.sigKey, nil
+	}
+	c := modInst.DB()
+	defer c.Close()
+	var contentKey string
+	row := c.QueryRow("SELECT value FROM config WHERE name == `contentkey`;")
+	if err := row.Scan(&contentKey); err != nil {
+		return nil, err
+	}
+	key, err := hushcom.SigningKey(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	modInst.sigKey = key
+	return key, nil
+}
+
 // GetName - Getter for readable name of the module
 func (*Server) GetName() string {
 	return "HushCom Server Module"
 }
 
-// HandleMsg - handler for messages
+// user - a registered user, nil if there is none by that name
+func (modInst *Server) user(name string) *HCSrvUser {
+	modInst.usersMutex.RLock()
+	defer modInst.usersMutex.RUnlock()
+	return modInst.HCSrvUsers[name]
+}
+
+// channel - a channel, nil if there is none by that name. Lock its mutex before using it.
+func (modInst *Server) channel(name string) *HCSrvChan {
+	modInst.chansMutex.RLock()
+	defer modInst.chansMutex.RUnlock()
+	return modInst.HCSrvChans[name]
+}
+
+// chansChanged - call after a channel is added, or its name, key or visibility change
+func (modInst *Server) chansChanged() {
+	modInst.chanListMutex.Lock()
+	modInst.chanList = nil
+	modInst.chanListGen++
+	modInst.chanListMutex.Unlock()
+}
+
+// publicChans - the channels ListChans returns, by name
+func (modInst *Server) publicChans() []hushcom.Channel {
+	modInst.chanListMutex.Lock()
+	chans, gen := modInst.chanList, modInst.chanListGen
+	modInst.chanListMutex.Unlock()
+	if chans != nil {
+		return chans
+	}
+	chans = []hushcom.Channel{}
+	modInst.chansMutex.RLock()
+	for channel := range modInst.HCSrvChans {
+		srvChan := modInst.HCSrvChans[channel]
+		srvChan.mutex.Lock()
+		if !srvChan.Private {
+			var c hushcom.Channel
+			c.Name = channel
+			c.PubKey = srvChan.Key.ToB64()
+			c.HasPassword = srvChan.Password != ""
+			chans = append(chans, c)
+		}
+		srvChan.mutex.Unlock()
+	}
+	modInst.chansMutex.RUnlock()
+	sort.Slice(chans, func(i, j int) bool { return chans[i].Name < chans[j].Name })
+	// keep it, unless a channel changed while it was being made
+	modInst.chanListMutex.Lock()
+	if modInst.chanListGen == gen {
+		modInst.chanList = chans
+	}
+	modInst.chanListMutex.Unlock()
+	return chans
+}
+
+// dropChan - remove a channel its last member has left, unless someone joined it since
+func (modInst *Server) dropChan(name string, srvChan *HCSrvChan) error {
+	modInst.chansMutex.Lock()
+	defer modInst.chansMutex.Unlock()
+	srvChan.mutex.Lock()
+	defer srvChan.mutex.Unlock()
+	if modInst.HCSrvChans[name] != srvChan || !srvChan.empty() {
+		return nil
+	}
+	delete(modInst.HCSrvChans, name)
+	modInst.chansChanged()
+	if modInst.Store != nil {
+		return modInst.Store.DeleteChan(name)
+	}
+	return nil
+}
+
+// ownedChans - number of channels nick owns. Hold chansMutex.
+func (modInst *Server) ownedChans(nick string) int {
+	n := 0
+	for _, srvChan := range modInst.HCSrvChans {
+		srvChan.mutex.Lock()
+		if srvChan.Owner == nick {
+			n++
+		}
+		srvChan.mutex.Unlock()
+	}
+	return n
+}
+
+// HandleMsg - handler for messages. Rejected messages return a *ProtocolError.
 func (modInst *Server) HandleMsg(msg api.Msg) error {
 
 	//	log.Println("HushCom Server HandleDispatch")
 
-	// Create a decoder and receive a value.
-	dec := gob.NewDecoder(msg.Content)
-	var metaData hushcom.Msg
-	err := dec.Decode(&metaData)
+	metaData, err := modInst.decodeMsg(msg)
 	if err != nil {
-		log.Fatal("gob decode:", err)
+		return modInst.reject(metaData, err)
 	}
-	var l func(...interface{})
-	if metaData.MsgType == "ListChans" {
-		l = func(params ...interface{}) {}
-	} else {
-		l = log.Println
+	return modInst.process(metaData)
+}
+
+// process - handle a decoded message, counting it if it's rejected
+func (modInst *Server) process(metaData hushcom.Msg) error {
+	return modInst.reject(metaData, modInst.handle(metaData))
+}
+
+// handle - handler for decoded messages
+func (modInst *Server) handle(metaData hushcom.Msg) error {
+	// shed load before spending time on signatures
+	if !modInst.limiter.allowGlobal(&modInst.Limits, time.Now()) {
+		return protocolError(hushcom.ErrCodeThrottled, ErrThrottled)
 	}
-	l("Message Type: ", metaData.MsgType)
+	return modInst.handleSender(metaData)
+}
 
-	userKey := modInst.HCSrvUsers[metaData.From]
-	var newUser = true
+// authenticate - the sender's record, checked against the message signature. For a Register
+// from a new user, that's the record it would create, and newUser is true.
+func (modInst *Server) authenticate(metaData hushcom.Msg) (user *HCSrvUser, newUser bool, err error) {
+	user = modInst.user(metaData.From)
+	newUser = true
 	// is this a register message
 	if metaData.MsgType == "Register" {
-		log.Println("HushCom Server Register Message Received")
-		if userKey != nil {
-			newUser = false
-			log.Println("User " + metaData.From + " is already registered")
-		}
 		// unmarshal msg into msgObj
 		var msgObj hushcom.RegisterMsg
 		if err := json.Unmarshal(metaData.Data, &msgObj); err != nil {
-			return errors.New("Could not unmarshal 'Register' message:\n" + string(metaData.Data))
+			return nil, false, malformed("Could not unmarshal 'Register' message")
 		}
-		k := new(ecc.PubKey)
-		if err := k.FromB64(msgObj.Key); err != nil {
-			return err
+		if user != nil {
+			newUser = false
+		} else {
+			k := new(ecc.PubKey)
+			if err := k.FromB64(msgObj.Key); err != nil {
+				return nil, false, protocolError(hushcom.ErrCodeMalformed, err)
+			}
+			sk, err := hushcom.SigKeyFromB64(msgObj.SigKey)
+			if err != nil {
+				return nil, false, protocolError(hushcom.ErrCodeMalformed, err)
+			}
+			user = &HCSrvUser{Key: k, SigKey: sk}
 		}
-		userKey = k
 	}
-	if userKey == nil {
-		// this is not a register message and it isn't signed, so ignore
-		return nil //todo: return security error of some kind?
+	if user == nil {
+		// this is not a register message and there's no key to check it against
+		return nil, false, protocolError(hushcom.ErrCodeUnauthenticated, errors.New("Unknown user "+metaData.From))
+	}
+
+	// Verify that the msg signature matches the user's signing key (or new key for Register).
+	// A re-Register must be signed by the key already on file, so a nick can't be taken over.
+	if !hushcom.VerifyMsg(user.SigKey, metaData) {
+		return nil, false, protocolError(hushcom.ErrCodeUnauthenticated,
+			errors.New("Failure to authenticate user: "+metaData.From+" with signature "+hex.EncodeToString(metaData.Sig)+"."))
 	}
-	//	log.Println("user key: ", userKey)
+	return user, newUser, nil
+}
 
-	// Verify that the msg signature matches the user's key (or new key for Register)
-	if !hushcom.VerifyMsg(userKey, metaData) {
-		return errors.New("Failure to authenticate user: " + metaData.From + " with signature " + hex.EncodeToString(metaData.Sig) + ".")
+// handleSender - handler for messages under the global rate limit
+func (modInst *Server) handleSender(metaData hushcom.Msg) error {
+	var l func(...interface{})
+	if metaData.MsgType == "ListChans" {
+		l = func(params ...interface{}) {}
+	} else {
+		l = log.Println
+	}
+	l("Message Type: ", metaData.MsgType)
+	if metaData.MsgType == "Register" {
+		log.Println("HushCom Server Register Message Received")
+	}
+
+	user, newUser, err := modInst.authenticate(metaData)
+	if err != nil {
+		return err
 	}
 	// At this point, the message is considered authenticated.
 
 	l("... passed auth: ", metaData.MsgType)
+	if metaData.MsgType == "Register" && !newUser {
+		log.Println("User " + metaData.From + " is already registered")
+	}
+
+	// Drop stale and replayed messages
+	if modInst.Replay != nil {
+		if err := modInst.Replay.Check(metaData); err != nil {
+			return protocolError(hushcom.ErrCodeReplayed, err)
+		}
+	}
+
+	// Drop messages over the sender's rate limits, telling them once
+	if ok, notice := modInst.limiter.allow(&modInst.Limits, metaData.From, metaData.MsgType, time.Now()); !ok {
+		perr := protocolError(hushcom.ErrCodeThrottled, ErrThrottled)
+		perr.Authenticated = true
+		perr.quiet = !notice
+		return perr
+	}
+
+	if err := modInst.dispatch(metaData, user, newUser, l); err != nil {
+		// the sender is who they say they are, so they may be told what went wrong
+		var perr *ProtocolError
+		if !errors.As(err, &perr) {
+			perr = protocolError(hushcom.ErrCodeInternal, err)
+		}
+		perr.Authenticated = true
+		return perr
+	}
+	return nil
+}
 
+// dispatch - handler for authenticated messages
+func (modInst *Server) dispatch(metaData hushcom.Msg, user *HCSrvUser, newUser bool, l func(...interface{})) error {
 	// Message Type Handlers
 	switch metaData.MsgType {
 
 	// Server-Handled Messages:
 	// - Register: Register a new nick/pubkey pair
 	// - Unregister: Remove a nick/pubkey pair
-	// - ListChans: Enumerate public channels
+	// - ListChans: Enumerate public (non-private) channels
 	// - NewChan: Create a new channel
+	// - Whois: Look up a user's keys
+	// - RotateChanKey: Replace a channel's pubkey (admins only)
+	// - ChanJoined: Add the sender to a channel's members (with proof of the channel key)
+	// - ChanPart: Remove the sender from a channel
+	// - Names: List a channel's admins and members
+	// - Kick, Ban, Unban, Op, Deop, TransferOwner: Channel administration (admins only)
 
 	case "Register":
 		if newUser {
 			// yay! New user!
-			modInst.HCSrvUsers[metaData.From] = userKey
+			modInst.usersMutex.Lock()
+			if modInst.HCSrvUsers[metaData.From] != nil {
+				// someone else got there between the lookup and now
+				modInst.usersMutex.Unlock()
+				return refused("User " + metaData.From + " is already registered")
+			}
+			modInst.HCSrvUsers[metaData.From] = user
+			modInst.usersMutex.Unlock()
+			if modInst.Store != nil {
+				if err := modInst.Store.SaveUser(metaData.From, user); err != nil {
+					return err
+				}
+			}
 
-			if err := modInst.Node.AddContact(metaData.From, userKey.ToB64()); err != nil {
+			if err := modInst.Node.AddContact(metaData.From, user.Key.ToB64()); err != nil {
 				return err
 			}
 		}
@@ -146,6 +499,7 @@ func (modInst *Server) HandleMsg(msg api.Msg) error {
 		msg.From = modInst.GetName()
 		msg.MsgType = "RegisterResp"
 		msg.Timestamp = time.Now().UTC().UnixNano()
+		msg.RequestID = metaData.RequestID
 		var reg hushcom.RegisterRespMsg
 		reg.Success = true
 		jsonb, err := json.Marshal(reg)
@@ -155,35 +509,50 @@ func (modInst *Server) HandleMsg(msg api.Msg) error {
 		msg.Data = jsonb
 		return modInst.sendToClient(msg, metaData.From)
 
-	case "UnRegister":
-		// remove user from all chans
-		for _, channel := range modInst.HCSrvChans {
-			for _, user := range channel.Users {
-				if user == metaData.From {
-					rmFrmList(&channel.Admins, metaData.From)
-					rmFrmList(&channel.Users, metaData.From)
+	case "UnRegister", "Unregister":
+		// remove user from all chans, and hand over the ones they own
+		dropped := make(map[string]*HCSrvChan)
+		modInst.chansMutex.RLock()
+		for name, channel := range modInst.HCSrvChans {
+			channel.mutex.Lock()
+			if channel.part(metaData.From) {
+				if channel.empty() {
+					dropped[name] = channel
+				} else if modInst.Store != nil {
+					if err := modInst.Store.SaveChan(name, channel); err != nil {
+						channel.mutex.Unlock()
+						modInst.chansMutex.RUnlock()
+						return err
+					}
 				}
 			}
+			channel.mutex.Unlock()
+		}
+		modInst.chansMutex.RUnlock()
+		// and remove the chans they were the last one in
+		for name, channel := range dropped {
+			if err := modInst.dropChan(name, channel); err != nil {
+				return err
+			}
 		}
 		// remove user's key from master key list
+		modInst.usersMutex.Lock()
 		delete(modInst.HCSrvUsers, metaData.From)
+		modInst.usersMutex.Unlock()
+		if modInst.Store != nil {
+			if err := modInst.Store.DeleteUser(metaData.From); err != nil {
+				return err
+			}
+		}
 
 	case "ListChans":
 		// get list of public chans
-		var chans []hushcom.Channel
-		for channel := range modInst.HCSrvChans {
-			srvChan := modInst.HCSrvChans[channel]
-			if srvChan.Password == "" {
-				var c hushcom.Channel
-				c.Name = channel
-				c.PubKey = srvChan.Key.ToB64()
-				chans = append(chans, c)
-			}
-		}
+		chans := modInst.publicChans()
 		var msg hushcom.Msg
 		msg.From = modInst.GetName()
 		msg.MsgType = "ListChansResp"
 		msg.Timestamp = time.Now().UTC().UnixNano()
+		msg.RequestID = metaData.RequestID
 
 		var reg hushcom.ListChansRespMsg
 		reg.Channels = chans
@@ -199,41 +568,296 @@ func (modInst *Server) HandleMsg(msg api.Msg) error {
 		// unmarshal msg into msgObj
 		var msgObj hushcom.NewChanMsg
 		if err := json.Unmarshal(metaData.Data, &msgObj); err != nil {
-			return errors.New("Could not unmarshal 'NewChan' message")
+			return malformed("Could not unmarshal 'NewChan' message")
 		}
-		// does this channel exist?
+		// only ever store a password hash
+		if msgObj.ChanPassword != "" && !hushcom.ValidPasswordHash(msgObj.ChanPassword) {
+			return refused("Error creating channel - password is not a salted hash")
+		}
+		k := new(ecc.PubKey)
+		if err := k.FromB64(msgObj.ChanPubKey); err != nil {
+			return protocolError(hushcom.ErrCodeMalformed, err)
+		}
+		sk, err := hushcom.SigKeyFromB64(msgObj.ChanSigKey)
+		if err != nil {
+			return protocolError(hushcom.ErrCodeMalformed, err)
+		}
+		srvChan := new(HCSrvChan)                              // make chan object
+		srvChan.Key = k                                        // add chan key
+		srvChan.SigKey = sk                                    // add chan signing key
+		srvChan.Password = msgObj.ChanPassword                 // add password hash (optional)
+		srvChan.Private = msgObj.Private                       // hide from ListChans (optional)
+		srvChan.Owner = metaData.From                          // make user the chan owner
+		srvChan.Admins = append(srvChan.Admins, metaData.From) // make user a chan admin
+		srvChan.Users = append(srvChan.Users, metaData.From)   // and a member
+
+		// does this channel exist? (held until the new one is in the map)
+		modInst.chansMutex.Lock()
 		if modInst.HCSrvChans[msgObj.ChanName] != nil {
-			return errors.New("Error creating channel - already exists")
+			modInst.chansMutex.Unlock()
+			return refused("Error creating channel - already exists")
+		}
+		if max := modInst.Limits.MaxChansPerUser; max > 0 && modInst.ownedChans(metaData.From) >= max {
+			modInst.chansMutex.Unlock()
+			return refused("Error creating channel - " + metaData.From + " already owns " + strconv.Itoa(max) + " channels")
+		}
+		// nobody else gets at the channel until it's saved
+		srvChan.mutex.Lock()
+		modInst.HCSrvChans[msgObj.ChanName] = srvChan
+		modInst.chansMutex.Unlock()
+		if modInst.Store != nil {
+			if err := modInst.Store.SaveChan(msgObj.ChanName, srvChan); err != nil {
+				srvChan.mutex.Unlock()
+				modInst.chansMutex.Lock()
+				if modInst.HCSrvChans[msgObj.ChanName] == srvChan {
+					delete(modInst.HCSrvChans, msgObj.ChanName)
+				}
+				modInst.chansMutex.Unlock()
+				return err
+			}
+		}
+		srvChan.mutex.Unlock()
+		modInst.chansChanged()
+		l("New Channel Registered with pubkey: ", msgObj)
+
+		var msg hushcom.Msg
+		msg.From = modInst.GetName()
+		msg.MsgType = "NewChanResp"
+		msg.Timestamp = time.Now().UTC().UnixNano()
+		msg.RequestID = metaData.RequestID
+		jsonb, err := json.Marshal(hushcom.NewChanRespMsg{ChanName: msgObj.ChanName})
+		if err != nil {
+			return err
 		}
-		// if channel doesn't exist, create channel
-		modInst.HCSrvChans[msgObj.ChanName] = new(HCSrvChan) // make chan object
+		msg.Data = jsonb
+		return modInst.sendToClient(msg, metaData.From)
 
+	case "RotateChanKey":
+		var msgObj hushcom.RotateChanKeyMsg
+		if err := json.Unmarshal(metaData.Data, &msgObj); err != nil {
+			return malformed("Could not unmarshal 'RotateChanKey' message")
+		}
+		srvChan := modInst.channel(msgObj.ChanName)
+		if srvChan == nil {
+			return refused("Error rotating channel key - no such channel")
+		}
+		srvChan.mutex.Lock()
+		defer srvChan.mutex.Unlock()
+		if !chkList(&srvChan.Admins, metaData.From) {
+			return refused("Error rotating channel key - " + metaData.From + " is not an admin of " + msgObj.ChanName)
+		}
 		k := new(ecc.PubKey)
 		if err := k.FromB64(msgObj.ChanPubKey); err != nil {
+			return protocolError(hushcom.ErrCodeMalformed, err)
+		}
+		sk, err := hushcom.SigKeyFromB64(msgObj.ChanSigKey)
+		if err != nil {
+			return protocolError(hushcom.ErrCodeMalformed, err)
+		}
+		srvChan.Key = k
+		srvChan.SigKey = sk
+		srvChan.Kicked = nil // a proof with the new key comes from someone who was let back in
+		if modInst.Store != nil {
+			if err := modInst.Store.SaveChan(msgObj.ChanName, srvChan); err != nil {
+				return err
+			}
+		}
+		modInst.chansChanged()
+		l("Channel key rotated: ", msgObj)
+
+		var msg hushcom.Msg
+		msg.From = modInst.GetName()
+		msg.MsgType = "RotateChanKeyResp"
+		msg.Timestamp = time.Now().UTC().UnixNano()
+		msg.RequestID = metaData.RequestID
+		jsonb, err := json.Marshal(hushcom.RotateChanKeyRespMsg{ChanName: msgObj.ChanName})
+		if err != nil {
 			return err
 		}
-		modInst.HCSrvChans[msgObj.ChanName].Key = k // add chan key
+		msg.Data = jsonb
+		return modInst.sendToClient(msg, metaData.From)
 
-		modInst.HCSrvChans[msgObj.ChanName].Password = msgObj.ChanPassword // add password (optional)
-		modInst.HCSrvChans[msgObj.ChanName].Admins = append(               // make user a chan admin
-			modInst.HCSrvChans[msgObj.ChanName].Admins,
-			metaData.From,
-		)
-		l("New Channel Registered with pubkey: ", msgObj)
+	case "ChanJoined":
+		var msgObj hushcom.ChanJoinedMsg
+		if err := json.Unmarshal(metaData.Data, &msgObj); err != nil {
+			return malformed("Could not unmarshal 'ChanJoined' message")
+		}
+		srvChan := modInst.channel(msgObj.Channel)
+		if srvChan == nil {
+			return refused("Error joining channel - no such channel")
+		}
+		srvChan.mutex.Lock()
+		defer srvChan.mutex.Unlock()
+		if !hushcom.VerifyChanMemberProof(srvChan.SigKey, msgObj.Channel, metaData.From, msgObj.Proof) {
+			return refused("Error joining channel - bad membership proof from " + metaData.From)
+		}
+		if chkList(&srvChan.Bans, metaData.From) {
+			return refused("Error joining channel - " + metaData.From + " is banned from " + msgObj.Channel)
+		}
+		if chkList(&srvChan.Kicked, metaData.From) {
+			return refused("Error joining channel - " + metaData.From + " was kicked from " + msgObj.Channel + " and needs the next key")
+		}
+		if !chkList(&srvChan.Users, metaData.From) {
+			srvChan.Users = append(srvChan.Users, metaData.From)
+			if modInst.Store != nil {
+				if err := modInst.Store.SaveChan(msgObj.Channel, srvChan); err != nil {
+					return err
+				}
+			}
+		}
+
+	case "ChanPart":
+		var msgObj hushcom.ChanPartMsg
+		if err := json.Unmarshal(metaData.Data, &msgObj); err != nil {
+			return malformed("Could not unmarshal 'ChanPart' message")
+		}
+		srvChan := modInst.channel(msgObj.Channel)
+		if srvChan == nil {
+			return refused("Error leaving channel - no such channel")
+		}
+		srvChan.mutex.Lock()
+		parted, empty := srvChan.part(metaData.From), srvChan.empty()
+		if parted && !empty && modInst.Store != nil {
+			if err := modInst.Store.SaveChan(msgObj.Channel, srvChan); err != nil {
+				srvChan.mutex.Unlock()
+				return err
+			}
+		}
+		srvChan.mutex.Unlock()
+		if parted && empty {
+			// the last one out, nobody is left to hold the key
+			return modInst.dropChan(msgObj.Channel, srvChan)
+		}
+
+	case "Names":
+		var msgObj hushcom.NamesMsg
+		if err := json.Unmarshal(metaData.Data, &msgObj); err != nil {
+			return malformed("Could not unmarshal 'Names' message")
+		}
+		srvChan := modInst.channel(msgObj.Channel)
+		if srvChan == nil {
+			return refused("Error listing channel members - no such channel")
+		}
+		srvChan.mutex.Lock()
+		defer srvChan.mutex.Unlock()
+		// private channel membership is only visible to members
+		if srvChan.Private && !chkList(&srvChan.Users, metaData.From) && !chkList(&srvChan.Admins, metaData.From) {
+			return refused("Error listing channel members - " + metaData.From + " is not a member of " + msgObj.Channel)
+		}
+		var resp hushcom.NamesRespMsg
+		resp.Channel = msgObj.Channel
+		resp.Owner = srvChan.Owner
+		resp.Admins = srvChan.Admins
+		resp.Users = srvChan.Users
+		// who is banned is for the admins to know
+		if chkList(&srvChan.Admins, metaData.From) {
+			resp.Bans = srvChan.Bans
+		}
+		resp.ChanSigKey = hushcom.SigKeyToB64(srvChan.SigKey)
+		var msg hushcom.Msg
+		msg.From = modInst.GetName()
+		msg.MsgType = "NamesResp"
+		msg.Timestamp = time.Now().UTC().UnixNano()
+		msg.RequestID = metaData.RequestID
+		jsonb, err := json.Marshal(resp)
+		if err != nil {
+			return err
+		}
+		msg.Data = jsonb
+		return modInst.sendToClient(msg, metaData.From)
+
+	case "Kick", "Ban", "Unban", "Op", "Deop", "TransferOwner":
+		var msgObj hushcom.ChanAdminMsg
+		if err := json.Unmarshal(metaData.Data, &msgObj); err != nil {
+			return malformed("Could not unmarshal '" + metaData.MsgType + "' message")
+		}
+		srvChan := modInst.channel(msgObj.Channel)
+		if srvChan == nil {
+			return refused("Error in " + metaData.MsgType + " - no such channel")
+		}
+		srvChan.mutex.Lock()
+		defer srvChan.mutex.Unlock()
+		if err := srvChan.admin(metaData.MsgType, metaData.From, msgObj.Nick); err != nil {
+			return refused("Error in " + metaData.MsgType + " on " + msgObj.Channel + " - " + err.Error())
+		}
+		if modInst.Store != nil {
+			if err := modInst.Store.SaveChan(msgObj.Channel, srvChan); err != nil {
+				return err
+			}
+		}
+		l(metaData.MsgType+" on "+msgObj.Channel+": ", msgObj.Nick, " by ", metaData.From)
+
+		var resp hushcom.ChanAdminRespMsg
+		resp.Action = metaData.MsgType
+		resp.Channel = msgObj.Channel
+		resp.Nick = msgObj.Nick
+		resp.By = metaData.From
+		resp.Owner = srvChan.Owner
+		resp.Admins = srvChan.Admins
+		resp.Users = srvChan.Users
+		resp.Bans = srvChan.Bans
+		var msg hushcom.Msg
+		msg.From = modInst.GetName()
+		msg.MsgType = "ChanAdminResp"
+		msg.Timestamp = time.Now().UTC().UnixNano()
+		msg.RequestID = metaData.RequestID
+		jsonb, err := json.Marshal(resp)
+		if err != nil {
+			return err
+		}
+		msg.Data = jsonb
+		if err := modInst.sendToClient(msg, metaData.From); err != nil {
+			return err
+		}
+		// let the affected user know, if they're still registered
+		if msgObj.Nick != metaData.From && modInst.user(msgObj.Nick) != nil {
+			msg.RequestID = "" // not their request
+			if !chkList(&srvChan.Admins, msgObj.Nick) {
+				resp.Bans = nil
+				if msg.Data, err = json.Marshal(resp); err != nil {
+					return err
+				}
+			}
+			return modInst.sendToClient(msg, msgObj.Nick)
+		}
+
+	case "Whois":
+		var msgObj hushcom.WhoisMsg
+		if err := json.Unmarshal(metaData.Data, &msgObj); err != nil {
+			return malformed("Could not unmarshal 'Whois' message")
+		}
+		var resp hushcom.WhoisRespMsg
+		resp.Name = msgObj.Name
+		if whois := modInst.user(msgObj.Name); whois != nil {
+			resp.Found = true
+			resp.Key = whois.Key.ToB64()
+			resp.SigKey = hushcom.SigKeyToB64(whois.SigKey)
+		}
+		var msg hushcom.Msg
+		msg.From = modInst.GetName()
+		msg.MsgType = "WhoisResp"
+		msg.Timestamp = time.Now().UTC().UnixNano()
+		msg.RequestID = metaData.RequestID
+		jsonb, err := json.Marshal(resp)
+		if err != nil {
+			return err
+		}
+		msg.Data = jsonb
+		return modInst.sendToClient(msg, metaData.From)
 
 	default:
-		return errors.New("Unknown message type from user " + metaData.From + ".")
+		return protocolError(hushcom.ErrCodeUnknownType, errors.New("Unknown message type from user "+metaData.From+"."))
 	}
 
 	return nil
 }
 
 func (modInst *Server) sendToClient(msg hushcom.Msg, destName string) error {
-	cpubsrv, err := modInst.Node.CID()
+	sigKey, err := modInst.SigningKey()
 	if err != nil {
 		return err
 	}
-	msg.Sig, err = hushcom.SignMsg(cpubsrv, msg)
+	msg.Sig, err = hushcom.SignMsg(sigKey, msg)
 	if err != nil {
 		return err
 	}
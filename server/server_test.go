@@ -0,0 +1,414 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awgh/bencrypt/bc"
+	"github.com/awgh/bencrypt/ecc"
+	"github.com/awgh/hushcom"
+	"github.com/awgh/ratnet/api"
+	_ "modernc.org/ql/driver"
+)
+
+// testNode - the parts of a ratnet node the server uses, keeping what it sends
+type testNode struct {
+	api.Node
+	mutex sync.Mutex
+	sent  map[string][]hushcom.Msg
+}
+
+func (n *testNode) AddContact(name string, key string) error {
+	return nil
+}
+
+func (n *testNode) Send(contactName string, data []byte, pubkey ...bc.PubKey) error {
+	var msg hushcom.Msg
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&msg); err != nil {
+		return err
+	}
+	n.mutex.Lock()
+	n.sent[contactName] = append(n.sent[contactName], msg)
+	n.mutex.Unlock()
+	return nil
+}
+
+type testUser struct {
+	nick string
+	key  ed25519.PrivateKey
+}
+
+// newTestServer - a Server on a fresh QL database, with a testNode
+func newTestServer(t *testing.T) (*Server, *testNode) {
+	t.Helper()
+	path := t.TempDir() + "/hushcom.db"
+	node := &testNode{sent: make(map[string][]hushcom.Msg)}
+	server := New(node, func() *sql.DB {
+		c, err := sql.Open("ql2", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	})
+	if err := server.Load(); err != nil {
+		t.Fatal(err)
+	}
+	_, sigKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.sigKey = sigKey
+	return server, node
+}
+
+// register - a new user, registered with the server
+func register(t *testing.T, server *Server, nick string) *testUser {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &testUser{nick: nick, key: key}
+	content := new(ecc.KeyPair)
+	content.GenerateKey()
+	reg := hushcom.RegisterMsg{
+		Key:    content.GetPubKey().ToB64(),
+		SigKey: hushcom.SigKeyToB64(key.Public().(ed25519.PublicKey)),
+	}
+	if err := u.send(server, "Register", reg); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// send - sign and handle a message from u
+func (u *testUser) send(server *Server, msgType string, v interface{}) error {
+	var msg hushcom.Msg
+	msg.From = u.nick
+	msg.MsgType = msgType
+	msg.Timestamp = time.Now().UTC().UnixNano()
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	msg.Data = data
+	if msg.Sig, err = hushcom.SignMsg(u.key, msg); err != nil {
+		return err
+	}
+	return server.process(msg)
+}
+
+// newChan - make a channel owned by u, returning its private key
+func (u *testUser) newChan(t *testing.T, server *Server, name string) string {
+	t.Helper()
+	chanKey := new(ecc.KeyPair)
+	chanKey.GenerateKey()
+	sigKey, err := hushcom.ChanSigKey(chanKey.ToB64())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := hushcom.NewChanMsg{ChanName: name, ChanPubKey: chanKey.GetPubKey().ToB64(), ChanSigKey: sigKey}
+	if err := u.send(server, "NewChan", msg); err != nil {
+		t.Fatal(err)
+	}
+	return chanKey.ToB64()
+}
+
+// join - join a channel with proof of its key
+func (u *testUser) join(server *Server, channel, chanKey string) error {
+	proof, err := hushcom.ChanMemberProof(chanKey, channel, u.nick)
+	if err != nil {
+		return err
+	}
+	return u.send(server, "ChanJoined", hushcom.ChanJoinedMsg{Channel: channel, Proof: proof})
+}
+
+// errCode - the ErrCode of a rejection, empty if err isn't one
+func errCode(err error) string {
+	var perr *ProtocolError
+	if errors.As(err, &perr) {
+		return perr.Code
+	}
+	return ""
+}
+
+// errorResps - how many ErrorResp the server sent to nick
+func (n *testNode) errorResps(nick string) int {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	count := 0
+	for _, msg := range n.sent[nick] {
+		if msg.MsgType == "ErrorResp" {
+			count++
+		}
+	}
+	return count
+}
+
+// stored - the channels the server's Store has
+func stored(t *testing.T, server *Server) map[string]*HCSrvChan {
+	t.Helper()
+	chans := make(map[string]*HCSrvChan)
+	if err := server.Store.Load(chans, make(map[string]*HCSrvUser)); err != nil {
+		t.Fatal(err)
+	}
+	return chans
+}
+
+func TestLastPartDropsChan(t *testing.T) {
+	server, _ := newTestServer(t)
+	alice := register(t, server, "alice")
+	bob := register(t, server, "bob")
+	key := alice.newChan(t, server, "#a")
+	if err := bob.join(server, "#a", key); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := alice.send(server, "ChanPart", hushcom.ChanPartMsg{Channel: "#a"}); err != nil {
+		t.Fatal(err)
+	}
+	if c := stored(t, server)["#a"]; c == nil || c.Owner != "bob" {
+		t.Fatalf("channel after the owner left: %+v, want it handed to bob", c)
+	}
+
+	if err := bob.send(server, "ChanPart", hushcom.ChanPartMsg{Channel: "#a"}); err != nil {
+		t.Fatal(err)
+	}
+	if server.channel("#a") != nil {
+		t.Error("channel still on the server after the last member left")
+	}
+	if stored(t, server)["#a"] != nil {
+		t.Error("channel still in the store after the last member left")
+	}
+}
+
+func TestLastUnregisterDropsChan(t *testing.T) {
+	server, _ := newTestServer(t)
+	alice := register(t, server, "alice")
+	alice.newChan(t, server, "#a")
+	alice.newChan(t, server, "#b")
+	bob := register(t, server, "bob")
+	key := bob.newChan(t, server, "#c")
+	if err := alice.join(server, "#c", key); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := alice.send(server, "Unregister", struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	chans := stored(t, server)
+	for _, name := range []string{"#a", "#b"} {
+		if server.channel(name) != nil || chans[name] != nil {
+			t.Errorf("%s kept after its only member unregistered", name)
+		}
+	}
+	if server.channel("#c") == nil || chans["#c"] == nil {
+		t.Error("#c dropped while bob is still in it")
+	}
+}
+
+func TestOnlyOwnerRemovesAdmin(t *testing.T) {
+	server, _ := newTestServer(t)
+	alice := register(t, server, "alice")
+	bob := register(t, server, "bob")
+	carol := register(t, server, "carol")
+	key := alice.newChan(t, server, "#a")
+	for _, u := range []*testUser{bob, carol} {
+		if err := u.join(server, "#a", key); err != nil {
+			t.Fatal(err)
+		}
+		if err := alice.send(server, "Op", hushcom.ChanAdminMsg{Channel: "#a", Nick: u.nick}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, action := range []string{"Kick", "Ban", "Deop"} {
+		if err := bob.send(server, action, hushcom.ChanAdminMsg{Channel: "#a", Nick: "carol"}); err == nil {
+			t.Errorf("admin bob could %s admin carol", action)
+		}
+	}
+	if c := server.channel("#a"); !chkList(&c.Admins, "carol") || chkList(&c.Bans, "carol") {
+		t.Fatalf("carol after bob's attempts: %+v", c)
+	}
+
+	if err := alice.send(server, "Ban", hushcom.ChanAdminMsg{Channel: "#a", Nick: "carol"}); err != nil {
+		t.Fatal(err)
+	}
+	if c := server.channel("#a"); chkList(&c.Admins, "carol") || !chkList(&c.Bans, "carol") {
+		t.Errorf("carol after the owner banned carol: %+v", c)
+	}
+}
+
+func TestNewChanLimits(t *testing.T) {
+	server, node := newTestServer(t)
+	server.Limits.MaxChansPerUser = 2
+	server.Limits.PerType["NewChan"] = Limit{Rate: 1, Burst: 3}
+	alice := register(t, server, "alice")
+	alice.newChan(t, server, "#a")
+	alice.newChan(t, server, "#b")
+
+	newChan := func(name string) error {
+		key := new(ecc.KeyPair)
+		key.GenerateKey()
+		sigKey, err := hushcom.ChanSigKey(key.ToB64())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return alice.send(server, "NewChan",
+			hushcom.NewChanMsg{ChanName: name, ChanPubKey: key.GetPubKey().ToB64(), ChanSigKey: sigKey})
+	}
+	if err := newChan("#c"); errCode(err) != hushcom.ErrCodeRefused {
+		t.Fatalf("third channel of a user allowed 2: %v", err)
+	}
+	if server.channel("#c") != nil {
+		t.Error("#c created over the cap")
+	}
+
+	// the 4th NewChan is over the rate limit, which is noticed once
+	sent := node.errorResps("alice")
+	for i := 0; i < 2; i++ {
+		if err := newChan("#c"); errCode(err) != hushcom.ErrCodeThrottled {
+			t.Fatalf("NewChan over the rate limit: %v", err)
+		}
+	}
+	if got := node.errorResps("alice") - sent; got != 1 {
+		t.Errorf("%d ErrorResp for 2 throttled NewChan, want 1", got)
+	}
+
+	// other users and other messages aren't held back
+	bob := register(t, server, "bob")
+	bob.newChan(t, server, "#b2")
+	if err := alice.send(server, "Whois", hushcom.WhoisMsg{Name: "bob"}); err != nil {
+		t.Errorf("Whois after throttled NewChan: %v", err)
+	}
+}
+
+// rotate - give a channel a new key, returning its private key
+func (u *testUser) rotate(server *Server, name string) (string, error) {
+	key := new(ecc.KeyPair)
+	key.GenerateKey()
+	sigKey, err := hushcom.ChanSigKey(key.ToB64())
+	if err != nil {
+		return "", err
+	}
+	msg := hushcom.RotateChanKeyMsg{ChanName: name, ChanPubKey: key.GetPubKey().ToB64(), ChanSigKey: sigKey}
+	return key.ToB64(), u.send(server, "RotateChanKey", msg)
+}
+
+func TestKickBanRejoin(t *testing.T) {
+	server, node := newTestServer(t)
+	alice := register(t, server, "alice")
+	bob := register(t, server, "bob")
+	carol := register(t, server, "carol")
+	key := alice.newChan(t, server, "#a")
+	for _, u := range []*testUser{bob, carol} {
+		if err := u.join(server, "#a", key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, action := range []string{"Kick", "Ban"} {
+		if err := bob.send(server, action, hushcom.ChanAdminMsg{Channel: "#a", Nick: "carol"}); errCode(err) != hushcom.ErrCodeRefused {
+			t.Errorf("%s by a non-admin: %v", action, err)
+		}
+	}
+	if err := alice.send(server, "Kick", hushcom.ChanAdminMsg{Channel: "#a", Nick: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.send(server, "Ban", hushcom.ChanAdminMsg{Channel: "#a", Nick: "carol"}); err != nil {
+		t.Fatal(err)
+	}
+	if c := stored(t, server)["#a"]; chkList(&c.Users, "bob") || chkList(&c.Users, "carol") {
+		t.Fatalf("members after kick and ban: %+v", c.Users)
+	}
+	// both were told
+	for _, nick := range []string{"bob", "carol"} {
+		node.mutex.Lock()
+		sent := node.sent[nick]
+		node.mutex.Unlock()
+		if len(sent) == 0 || sent[len(sent)-1].MsgType != "ChanAdminResp" {
+			t.Errorf("%s wasn't sent a ChanAdminResp", nick)
+		}
+	}
+	// the old key doesn't get them back in
+	for _, u := range []*testUser{bob, carol} {
+		if err := u.join(server, "#a", key); errCode(err) != hushcom.ErrCodeRefused {
+			t.Errorf("%s rejoined with the old key: %v", u.nick, err)
+		}
+	}
+
+	if _, err := bob.rotate(server, "#a"); errCode(err) != hushcom.ErrCodeRefused {
+		t.Errorf("rotation by a non-admin: %v", err)
+	}
+	newKey, err := alice.rotate(server, "#a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.mutex.Lock()
+	sent := node.sent["alice"]
+	node.mutex.Unlock()
+	if sent[len(sent)-1].MsgType != "RotateChanKeyResp" {
+		t.Errorf("rotation answered with %s", sent[len(sent)-1].MsgType)
+	}
+	if err := bob.join(server, "#a", key); errCode(err) != hushcom.ErrCodeRefused {
+		t.Errorf("joined with the retired key: %v", err)
+	}
+	// let back in with the new key, which the banned can't use
+	if err := bob.join(server, "#a", newKey); err != nil {
+		t.Errorf("kicked bob with the new key: %v", err)
+	}
+	if err := carol.join(server, "#a", newKey); errCode(err) != hushcom.ErrCodeRefused {
+		t.Errorf("banned carol joined with the new key: %v", err)
+	}
+	if err := alice.send(server, "Unban", hushcom.ChanAdminMsg{Channel: "#a", Nick: "carol"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := carol.join(server, "#a", newKey); err != nil {
+		t.Errorf("unbanned carol: %v", err)
+	}
+	if c := stored(t, server)["#a"]; !chkList(&c.Users, "bob") || !chkList(&c.Users, "carol") {
+		t.Errorf("members after rejoining: %+v", c.Users)
+	}
+}
+
+func TestNamesBansForAdmins(t *testing.T) {
+	server, node := newTestServer(t)
+	alice := register(t, server, "alice")
+	bob := register(t, server, "bob")
+	register(t, server, "carol")
+	key := alice.newChan(t, server, "#a")
+	if err := bob.join(server, "#a", key); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.send(server, "Ban", hushcom.ChanAdminMsg{Channel: "#a", Nick: "carol"}); err != nil {
+		t.Fatal(err)
+	}
+
+	names := func(u *testUser) hushcom.NamesRespMsg {
+		t.Helper()
+		if err := u.send(server, "Names", hushcom.NamesMsg{Channel: "#a"}); err != nil {
+			t.Fatal(err)
+		}
+		node.mutex.Lock()
+		msg := node.sent[u.nick][len(node.sent[u.nick])-1]
+		node.mutex.Unlock()
+		var resp hushcom.NamesRespMsg
+		if err := json.Unmarshal(msg.Data, &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	if resp := names(alice); len(resp.Bans) != 1 || resp.Bans[0] != "carol" {
+		t.Errorf("bans listed to the owner: %v", resp.Bans)
+	}
+	if resp := names(bob); len(resp.Bans) != 0 || resp.Owner != "alice" {
+		t.Errorf("NamesResp to a member who isn't an admin: %+v", resp)
+	}
+}
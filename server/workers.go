@@ -0,0 +1,140 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/awgh/hushcom"
+	"github.com/awgh/ratnet/api"
+)
+
+// DefaultWorkers - Goroutines handling messages, unless told otherwise
+const DefaultWorkers = 8
+
+// DefaultSenderQueue - Messages from one sender that may wait to be handled before more are dropped
+const DefaultSenderQueue = 64
+
+// ErrSenderQueueFull - A sender has too many messages waiting, the new one was dropped
+var ErrSenderQueueFull = errors.New("Sender queue full, message dropped")
+
+// Workers - Runs Server.HandleMsg on a pool of goroutines. Each sender's messages are handled
+// one at a time and in the order they came in, while different senders are handled in parallel.
+// A sender with messages waiting gets one handled and then goes to the back of the line, so a
+// busy or slow sender only ever ties up one worker, and can queue at most MaxQueue messages.
+type Workers struct {
+	MaxQueue int // per sender
+
+	server *Server
+	handle func(hushcom.Msg) error // runs each queued message
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	queues map[string][]hushcom.Msg // waiting messages, by sender. Present while the sender is ready or being handled
+	ready  []string                 // senders with messages waiting and no worker on them
+	wg     sync.WaitGroup
+	done   bool
+}
+
+// NewWorkers : Make a pool of n workers handling messages for this server, and start it
+func (modInst *Server) NewWorkers(n int) *Workers {
+	return modInst.newWorkers(n, func(metaData hushcom.Msg) error {
+		// checked again, the sender may have unregistered while it was queued
+		return modInst.reject(metaData, modInst.handleSender(metaData))
+	})
+}
+
+func (modInst *Server) newWorkers(n int, handle func(hushcom.Msg) error) *Workers {
+	if n < 1 {
+		n = 1
+	}
+	w := new(Workers)
+	w.MaxQueue = DefaultSenderQueue
+	w.server = modInst
+	w.handle = handle
+	w.cond = sync.NewCond(&w.mutex)
+	w.queues = make(map[string][]hushcom.Msg)
+	w.wg.Add(n)
+	for i := 0; i < n; i++ {
+		go w.work()
+	}
+	return w
+}
+
+// HandleMsg - Queue a message to be handled by the next free worker. Its signature is checked
+// first, so nobody can fill up another sender's queue. Messages that can't be decoded,
+// authenticated or queued return a *ProtocolError.
+func (w *Workers) HandleMsg(msg api.Msg) error {
+	metaData, err := w.server.decodeMsg(msg)
+	if err == nil {
+		err = w.submit(metaData)
+	}
+	return w.server.reject(metaData, err)
+}
+
+func (w *Workers) submit(metaData hushcom.Msg) error {
+	// shed load before spending time on signatures
+	if !w.server.limiter.allowGlobal(&w.server.Limits, time.Now()) {
+		return protocolError(hushcom.ErrCodeThrottled, ErrThrottled)
+	}
+	if _, _, err := w.server.authenticate(metaData); err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.done {
+		return errors.New("Workers stopped")
+	}
+	q, ok := w.queues[metaData.From]
+	if len(q) >= w.MaxQueue {
+		perr := protocolError(hushcom.ErrCodeQueueFull, ErrSenderQueueFull)
+		perr.Authenticated = true // checked above
+		return perr
+	}
+	if !ok {
+		w.ready = append(w.ready, metaData.From)
+		w.cond.Signal()
+	}
+	w.queues[metaData.From] = append(q, metaData)
+	return nil
+}
+
+func (w *Workers) work() {
+	defer w.wg.Done()
+	w.mutex.Lock()
+	for {
+		for len(w.ready) == 0 && !w.done {
+			w.cond.Wait()
+		}
+		if len(w.ready) == 0 {
+			w.mutex.Unlock()
+			return
+		}
+		from := w.ready[0]
+		w.ready = w.ready[1:]
+		metaData := w.queues[from][0]
+		w.queues[from] = w.queues[from][1:]
+		w.mutex.Unlock()
+
+		if err := w.handle(metaData); err != nil {
+			log.Println("hushcom server worker: " + err.Error())
+		}
+
+		w.mutex.Lock()
+		if len(w.queues[from]) == 0 {
+			delete(w.queues, from)
+		} else {
+			w.ready = append(w.ready, from)
+			w.cond.Signal()
+		}
+	}
+}
+
+// Stop - Handle the messages already queued, then stop the workers
+func (w *Workers) Stop() {
+	w.mutex.Lock()
+	w.done = true
+	w.cond.Broadcast()
+	w.mutex.Unlock()
+	w.wg.Wait()
+}
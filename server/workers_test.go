@@ -0,0 +1,93 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awgh/hushcom"
+)
+
+func TestWorkersSenderOrder(t *testing.T) {
+	const senders, perSender = 4, 50
+	server := New(nil, nil)
+	keys := make(map[string]ed25519.PrivateKey)
+	for i := 0; i < senders; i++ {
+		pub, priv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nick := "user" + strconv.Itoa(i)
+		server.HCSrvUsers[nick] = &HCSrvUser{SigKey: pub}
+		keys[nick] = priv
+	}
+
+	var mutex sync.Mutex
+	got := make(map[string][]int64)
+	busy := make(map[string]bool)
+	w := server.newWorkers(senders, func(metaData hushcom.Msg) error {
+		mutex.Lock()
+		if busy[metaData.From] {
+			t.Errorf("two messages from %s handled at once", metaData.From)
+		}
+		busy[metaData.From] = true
+		mutex.Unlock()
+
+		time.Sleep(time.Duration(metaData.Timestamp%3) * time.Millisecond)
+
+		mutex.Lock()
+		busy[metaData.From] = false
+		got[metaData.From] = append(got[metaData.From], metaData.Timestamp)
+		mutex.Unlock()
+		return nil
+	})
+
+	for n := 0; n < perSender; n++ {
+		for nick, key := range keys {
+			msg := hushcom.Msg{From: nick, MsgType: "ListChans", Timestamp: int64(n)}
+			sig, err := hushcom.SignMsg(key, msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg.Sig = sig
+			if err := w.submit(msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	w.Stop()
+
+	for nick := range keys {
+		if len(got[nick]) != perSender {
+			t.Fatalf("%s: handled %d messages, want %d", nick, len(got[nick]), perSender)
+		}
+		for i, ts := range got[nick] {
+			if ts != int64(i) {
+				t.Fatalf("%s: message %d handled in position %d", nick, ts, i)
+			}
+		}
+	}
+}
+
+func TestWorkersRejectUnsigned(t *testing.T) {
+	server := New(nil, nil)
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.HCSrvUsers["alice"] = &HCSrvUser{SigKey: pub}
+	w := server.newWorkers(1, func(metaData hushcom.Msg) error {
+		t.Errorf("handled an unauthenticated message from %s", metaData.From)
+		return nil
+	})
+	defer w.Stop()
+
+	if err := w.submit(hushcom.Msg{From: "alice", MsgType: "ListChans"}); err == nil {
+		t.Error("queued a message with no signature")
+	}
+	if err := w.submit(hushcom.Msg{From: "mallory", MsgType: "ListChans"}); err == nil {
+		t.Error("queued a message from an unknown user")
+	}
+}